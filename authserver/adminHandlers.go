@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+// Account events from the admin routes
+const (
+	EventUserUpdated         = "user_updated"
+	EventUserActivated       = "user_activated"
+	EventUserDeactivated     = "user_deactivated"
+	EventPrivilegesChanged   = "privileges_changed"
+	EventPasswordResetForced = "password_reset_forced"
+	EventSessionsRevoked     = "sessions_revoked"
+)
+
+func adminRoutes(r chi.Router) {
+	r.Use(TokenRequired)
+	r.Use(StaffRequired)
+	r.Use(RequireScope(ScopeAdmin))
+	r.Route("/users", func(r chi.Router) {
+		r.Get("/", adminListUsers)
+		r.Route("/{user_id}", func(r chi.Router) {
+			r.Use(AdminTargetCtx)
+			r.Get("/", adminGetUser)
+			r.Delete("/", adminEraseUser)
+			r.Delete("/deletion", adminCancelDeletion)
+			r.With(VerifyTypeMergePatch).Patch("/", adminModifyUser)
+			r.With(VerifyTypeJSON).Put("/active", adminSetActive)
+			r.With(VerifyTypeJSON, SuperUserVerify).Put("/privileges", adminSetPrivileges)
+			r.Post("/password-reset", adminForcePasswordReset)
+			r.Delete("/sessions", adminRevokeSessions)
+		})
+	})
+}
+
+// List and search users with private info. Same query params as GET /user,
+// plus staff=true|false.
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	filter, limit, err := parseUserFilter(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if v := r.URL.Query().Get("staff"); v != "" {
+		staff, err := strconv.ParseBool(v)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid value for staff")
+			return
+		}
+		filter.Staff = &staff
+	}
+
+	users, err := db.DbService().SearchUsers(r.Context(), filter, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeUserPage(w, users, limit, func(i int) int { return users[i].Id })
+}
+
+func adminGetUser(w http.ResponseWriter, r *http.Request) {
+	target := targetFrom(r.Context())
+	user, err := db.DbService().SelectPrivateUserById(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	utils.WriteJSON(w, user, 200)
+}
+
+// Edit any user's profile. Same JSON Merge Patch body as PATCH /user/{id}
+func adminModifyUser(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+
+	update, ok := decodeProfileUpdate(w, r)
+	if !ok {
+		return
+	}
+	if !applyProfileUpdate(w, r, target.Id, update) {
+		return
+	}
+
+	emitEvent(r.Context(), Event{
+		Name:    EventUserUpdated,
+		UserId:  target.Id,
+		ActorId: staff.UserId,
+		Detail:  map[string]any{"fields": update.Fields()},
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Activate or deactivate an account. Deactivating also removes all sessions.
+func adminSetActive(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+
+	var reqBody struct {
+		IsActive *bool `json:"is_active"`
+	}
+	err := decodeBody(w, r, &reqBody)
+	if err != nil || reqBody.IsActive == nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, "is_active is required")
+		return
+	}
+	if target.Id == staff.UserId {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot change your own account status")
+		return
+	}
+
+	err = db.DbService().SetUserActive(r.Context(), target.Id, *reqBody.IsActive)
+	if errors.Is(err, db.ErrNotFound) {
+		// erased accounts stay erased
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "User Not Found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	event := EventUserActivated
+	if !*reqBody.IsActive {
+		event = EventUserDeactivated
+		err = db.DbService().InvalidateAllSessions(r.Context(), target.Id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	emitEvent(r.Context(), Event{Name: event, UserId: target.Id, ActorId: staff.UserId})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Grant or remove staff and superuser. Superuser only, requires SuperUserVerify.
+// Sessions are removed so new access tokens carry the new privileges.
+func adminSetPrivileges(w http.ResponseWriter, r *http.Request) {
+	admin := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+
+	var reqBody struct {
+		IsStaff     *bool `json:"is_staff"`
+		IsSuperuser *bool `json:"is_superuser"`
+	}
+	err := decodeBody(w, r, &reqBody)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return
+	}
+	if target.Id == admin.UserId {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot change your own privileges")
+		return
+	}
+
+	isStaff, isSuperuser := target.IsStaff, target.IsSuperuser
+	if reqBody.IsStaff != nil {
+		isStaff = *reqBody.IsStaff
+	}
+	if reqBody.IsSuperuser != nil {
+		isSuperuser = *reqBody.IsSuperuser
+	}
+	// superusers are always staff
+	if isSuperuser {
+		isStaff = true
+	}
+
+	err = db.DbService().SetUserPrivileges(r.Context(), target.Id, isStaff, isSuperuser)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = db.DbService().InvalidateAllSessions(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{
+		Name:    EventPrivilegesChanged,
+		UserId:  target.Id,
+		ActorId: admin.UserId,
+		Detail:  map[string]any{"is_staff": isStaff, "is_superuser": isSuperuser},
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Clear the user's password and sessions, and issue a reset token.
+// The user cannot login until the password is changed with the token.
+// Staff targets get no token here, so staff can't take over each other's
+// accounts; they request their own through /user/password.
+func adminForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+
+	err := db.DbService().ClearUserHash(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = db.DbService().InvalidateAllSessions(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = db.DbService().DeleteUserApiKeys(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{Name: EventPasswordResetForced, UserId: target.Id, ActorId: staff.UserId})
+	if target.IsStaff || target.IsSuperuser {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	newToken, err := utils.GenerateCryptoString()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = db.DbService().NewUserSession(r.Context(), target.Id, newToken, true, db.SessionGrant{})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// This should go out via email
+	resjson := map[string]string{"reset_token": newToken}
+	utils.WriteJSON(w, resjson, 201)
+}
+
+func adminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+
+	err := db.DbService().InvalidateAllSessions(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = db.DbService().DeleteUserApiKeys(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{Name: EventSessionsRevoked, UserId: target.Id, ActorId: staff.UserId})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Erase a user's personal data immediately, skipping the grace period
+func adminEraseUser(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+	if target.Id == staff.UserId {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot erase your own account here")
+		return
+	}
+
+	err := eraseUser(r.Context(), target.Id, staff.UserId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Cancel a scheduled deletion and reactivate the account
+func adminCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	staff := PrincipalFrom(r.Context())
+	target := targetFrom(r.Context())
+	if target.DeletionScheduled == nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "No deletion scheduled")
+		return
+	}
+
+	err := db.DbService().ReactivateUser(r.Context(), target.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{Name: EventDeletionCancelled, UserId: target.Id, ActorId: staff.UserId})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
-	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -22,255 +23,364 @@ func index(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if code != "" {
 		var query *db.Country
-		query, err = db.DbService().GetCountry(code)
+		query, err = db.DbService().GetCountry(r.Context(), code)
 		result = query
 	} else {
 		var query *[]db.Country
-		query, err = db.DbService().GetAllCountries()
+		query, err = db.DbService().GetAllCountries(r.Context())
 		result = query
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	fmt.Println(result)
 	utils.WriteJSON(w, result, 200)
 }
 
 func CountryCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		countryCode := chi.URLParam(r, "country")
-		country, err := db.DbService().GetCountry(countryCode)
+		country, err := db.DbService().GetCountry(r.Context(), countryCode)
 		if err != nil {
-			http.Error(w, err.Error(), 404)
+			writeError(w, r, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), "country", country)
+		ctx := context.WithValue(r.Context(), countryKey{}, country)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func getCountry(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	country := ctx.Value("country").(*db.Country)
-	utils.WriteJSON(w, country, 200)
+	utils.WriteJSON(w, countryFrom(r.Context()), 200)
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
-	// enforce maximum decode size
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-
 	var u db.NewUser
-	err := dec.Decode(&u)
+	err := decodeBody(w, r, &u)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
 		return
 	}
-
-	err = db.DbService().InsertUser(u)
+	errs, err := validateNewUser(r.Context(), &u)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), 400)
+		writeError(w, r, err)
+		return
+	}
+	if len(errs) > 0 {
+		validationError(w, r, errs)
+		return
+	}
+	if failed := PWPolicy.Check(u.Password, u.Username, u.Email); len(failed) > 0 {
+		passwordPolicyError(w, r, failed)
 		return
 	}
-	uid := db.DbService().GetUserId(u.Username)
-	err = db.DbService().UpdateUserLoginTime(uid)
+
+	uid, err := db.DbService().InsertUser(r.Context(), u)
 	if err != nil {
-		http.Error(w, "Update Time Failed", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	w.Header().Add("Content-Location", fmt.Sprintf("/user/%d", uid))
 	w.WriteHeader(201)
 }
 
+// Search the user directory. Staff get private info and can match on
+// email and names, everyone else gets public info and matches usernames only.
+// Query params: query, country, active, joined_after, cursor, limit
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFrom(r.Context())
+	filter, limit, err := parseUserFilter(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	if user.IsStaff {
+		users, err := db.DbService().SearchUsers(r.Context(), filter, limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUserPage(w, users, limit, func(i int) int { return users[i].Id })
+		return
+	}
+	users, err := db.DbService().SearchPublicUsers(r.Context(), filter, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeUserPage(w, users, limit, func(i int) int { return users[i].Id })
+}
+
 // Get user info. Private info given if requested user is self or staff
 func getUserInfo(w http.ResponseWriter, r *http.Request) {
 	var userInfo any
 	var err error
 
-	user := r.Context().Value("user").(*utils.TokenClaims)
+	user := PrincipalFrom(r.Context())
 	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
 		return
 	}
-	if user.User_id == userRequested || user.Is_staff {
-		userInfo, err = db.DbService().SelectPrivateUserById(user.User_id)
+	if user.Is(userRequested) || user.IsStaff {
+		userInfo, err = db.DbService().SelectPrivateUserById(r.Context(), userRequested)
 	} else {
-		userInfo, err = db.DbService().SelectPublicUser(userRequested)
+		userInfo, err = db.DbService().SelectPublicUser(r.Context(), userRequested)
 	}
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	utils.WriteJSON(w, userInfo, 200)
 }
 
-// request JSON for login and account delete
+// request JSON or form for login and account delete.
+// grant_type is optional, OAuth clients send "password".
+// audience and scope restrict the tokens a login issues.
 type userCreds struct {
-	Username string
-	Password string
+	Username  string
+	Password  string
+	GrantType string `json:"grant_type"`
+	Audience  string
+	Scope     string
 }
 
 // Response with both tokens.
 // For login and token refreshing.
+// Cookie sessions get the CSRF token in place of the refresh token.
 type tokenResponse struct {
 	AccessToken  string
-	RefreshToken string
+	RefreshToken string `json:",omitempty"`
+	CsrfToken    string `json:",omitempty"`
+	Scope        string `json:",omitempty"`
 }
 
-// request JSON with refresh token
+// request JSON or form with refresh token.
+// grant_type is optional, OAuth clients send "refresh_token".
 type refreshToken struct {
-	Token string `json:"refresh_token"`
+	Token     string `json:"refresh_token"`
+	GrantType string `json:"grant_type"`
 }
 
 // main login handler, requires validateUserCreds middleware
 func loginUser(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value("user").(*db.UserAuth)
-	newAccess(w, user)
+	user := PrincipalFrom(r.Context()).Account
+	if user == nil {
+		// only a password login starts a session
+		writeProblem(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid Credentials")
+		return
+	}
+	if PWPolicy.Expired(user.PasswordChanged, user.IsStaff, user.IsSuperuser) {
+		writeProblem(w, r, http.StatusConflict, CodePasswordChangeRequired, "Password has expired")
+		return
+	}
+	// accounts deactivated by the user, including pending deletion, are
+	// reactivated by logging in. Staff deactivations are left to newAccess.
+	if !user.IsActive && user.SelfDeactivated {
+		err := db.DbService().ReactivateUser(r.Context(), user.Id)
+		if errors.Is(err, db.ErrNotFound) {
+			// erased since the credentials were checked
+			writeProblem(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid Credentials")
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		event := EventAccountReactivated
+		if user.DeletionScheduled != nil {
+			event = EventDeletionCancelled
+		}
+		emitEvent(r.Context(), Event{Name: event, UserId: user.Id, ActorId: user.Id})
+		user.IsActive = true
+	}
+	grant, problem := TokenGrants.validate(tokenRequestFrom(r.Context()), user.IsStaff)
+	if problem != nil {
+		sendProblem(w, r, problem)
+		return
+	}
+	newAccess(w, r, user, grant, wantsCookieSession(r))
 }
 
 // logout user by removing the refresh token for their current client.
 // It is up to the client to delete the Access Token.
+// Cookie sessions have their cookies cleared as well.
+// Tokens for any audience may log out, and expired ones too,
+// as long as the refresh token belongs to the same user.
 func logoutUser(w http.ResponseWriter, r *http.Request) {
-	var refresh refreshToken
-
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-
-	err := dec.Decode(&refresh)
+	token, fromCookie, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	userId, ok := sessionCaller(w, r, token, fromCookie)
+	if !ok {
+		return
+	}
+	owner, err := db.DbService().SelectSessionUserId(r.Context(), token)
+	if errors.Is(err, db.ErrNotFound) {
+		// already logged out
+		if fromCookie {
+			clearSessionCookies(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, err)
 		return
 	}
-	err = db.DbService().DeleteSession(refresh.Token)
+	if owner != userId {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Refresh token belongs to another user")
+		return
+	}
+	err = db.DbService().DeleteSession(r.Context(), token)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	if fromCookie {
+		clearSessionCookies(w)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func RefreshAccess(w http.ResponseWriter, r *http.Request) {
+// The user behind a refresh or logout request. The access token may be
+// expired or for another audience, cookie sessions may leave it out.
+func sessionCaller(w http.ResponseWriter, r *http.Request, token string, fromCookie bool) (int, bool) {
 	claims, err := TokenVerify(r)
-	if err != nil {
-		if err.Error() != "expired" {
-			http.Error(w, "Invalid Token, please login or check headers", http.StatusUnauthorized)
-			return
+	switch {
+	case err == nil || errors.Is(err, utils.ErrTokenExpired):
+		return claims.User_id, true
+	case fromCookie && errors.Is(err, utils.ErrTokenMissing):
+		userId, err := db.DbService().SelectSessionUserId(r.Context(), token)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			writeError(w, r, err)
+			return 0, false
 		}
+		return userId, true
+	default:
+		writeProblem(w, r, http.StatusUnauthorized, CodeTokenInvalid, "Invalid Token, please login or check headers")
+		return 0, false
 	}
+}
 
-	user, err := db.DbService().SelectUserAuth(claims.Username)
-	if err != nil {
-		http.Error(w, "Error finding User", 500)
+// Rotate the refresh token and issue a new access token.
+// Body clients send their access token, which may have expired.
+// Cookie sessions may leave it out, e.g. after a page reload.
+func RefreshAccess(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie, ok := readRefreshToken(w, r)
+	if !ok {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
+	userId, ok := sessionCaller(w, r, token, fromCookie)
+	if !ok {
+		return
+	}
 
-	var refresh refreshToken
-	err = dec.Decode(&refresh)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	loginRequired := func() {
+		if fromCookie {
+			clearSessionCookies(w)
+		}
+		writeProblem(w, r, http.StatusUnauthorized, CodeLoginRequired, "Login Required")
+	}
+	user, err := db.DbService().SelectUserAuthById(r.Context(), userId)
+	if errors.Is(err, db.ErrNotFound) {
+		loginRequired()
 		return
 	}
-	valid, err := db.DbService().QueryToken(refresh.Token, claims.User_id, false)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, r, err)
 		return
 	}
-	if !valid {
-		db.DbService().InvalidateAllSessions(claims.User_id)
-		http.Error(w, "Login Required", http.StatusUnauthorized)
+	if !user.IsActive {
+		writeProblem(w, r, http.StatusForbidden, CodeAccountDeactivated, "Account Deactivated")
 		return
 	}
-	err = db.DbService().InvalidateSession(refresh.Token)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	// sessions don't outlive the password, same as logging in
+	if PWPolicy.Expired(user.PasswordChanged, user.IsStaff, user.IsSuperuser) {
+		writeProblem(w, r, http.StatusConflict, CodePasswordChangeRequired, "Password has expired")
 		return
 	}
 
-	// extension
-	newAccess(w, user)
-}
-
-// struct used to validate json body
-type UserMod struct {
-	username   string
-	first_name string
-	last_name  string
-	email      string
-	phone      string
-	country    string
+	newToken, err := utils.GenerateCryptoString()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	grant, err := db.DbService().RotateSession(r.Context(), token, userId, newToken)
+	switch {
+	case errors.Is(err, db.ErrSessionReused):
+		// a used refresh token was presented again, assume it was stolen
+		refreshReuse.Inc()
+		loginRequired()
+	case errors.Is(err, db.ErrNotFound), errors.Is(err, db.ErrSessionInvalid):
+		loginRequired()
+	case err != nil:
+		writeError(w, r, err)
+	default:
+		sendTokens(w, r, user, grant, newToken, fromCookie)
+	}
 }
 
+// Partial profile update with JSON Merge Patch semantics.
+// Absent fields are unchanged, null clears a field.
 func modifyUser(w http.ResponseWriter, r *http.Request) {
 
-	user := r.Context().Value("user").(*utils.TokenClaims)
+	user := PrincipalFrom(r.Context())
 
 	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
 		return
 	}
-
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-
-	var u map[string]interface{}
-	err = dec.Decode(&u)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	if !user.Is(userRequested) && !user.IsStaff {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot change another user's info")
 		return
 	}
-	if user.User_id != userRequested && !user.Is_staff {
-		http.Error(w, "You cannot change another user's info", http.StatusForbidden)
+	if !user.Is(userRequested) && !superuserTargetAllowed(w, r, userRequested) {
 		return
 	}
-	// extension
-	// checking json -> map against UserMod struct
-	if !validateMap(u, UserMod{}) {
-		http.Error(w, "Invalid Fields included that do not exist or cannot be modified", http.StatusBadRequest)
+
+	update, ok := decodeProfileUpdate(w, r)
+	if !ok {
 		return
 	}
-
-	err2 := db.DbService().UpdateUserProfile(user.User_id, u)
-	if err2 != nil {
-		http.Error(w, err2.Error(), http.StatusInternalServerError)
+	if !applyProfileUpdate(w, r, userRequested, update) {
 		return
 	}
+	emitEvent(r.Context(), Event{
+		Name:    EventUserUpdated,
+		UserId:  userRequested,
+		ActorId: user.UserId,
+		Detail:  map[string]any{"fields": update.Fields()},
+	})
 	w.WriteHeader(http.StatusOK)
 }
 
 func createPasswordToken(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
-		Email string `db:"email"`
+		Email string `json:"email"`
+	}
+	err := decodeBody(w, r, &reqBody)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	dec.Decode(&reqBody)
-
-	uid := db.DbService().GetUserIdWithEmail(reqBody.Email)
-	newToken, _ := utils.GenerateCryptoString()
-	err := db.DbService().NewUserSession(uid, newToken, true)
+	newToken, err := utils.GenerateCryptoString()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// unknown emails get the same response with a token that is never
+	// stored, so the route can't be used to find out who has an account
+	err = db.DbService().NewPasswordResetSession(r.Context(), reqBody.Email, newToken)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	fmt.Printf("Reset Token: %s", newToken)
 
 	// This should go out via email
 	// w.WriteHeader(201)
@@ -284,110 +394,400 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&pwChangeReq)
+	err := decodeBody(w, r, &pwChangeReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidBody, err.Error())
+		return
+	}
+	uid, err := db.DbService().GetUserId(r.Context(), pwChangeReq.Username)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		writeError(w, r, err)
 		return
 	}
-	uid := db.DbService().GetUserId(pwChangeReq.Username)
-	valid, err := db.DbService().QueryToken(pwChangeReq.Token, uid, true)
+	valid, err := db.DbService().QueryToken(r.Context(), pwChangeReq.Token, uid, true)
 	if err != nil || !valid {
-		http.Error(w, "Invalid Token or Username", http.StatusForbidden)
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Invalid Token or Username")
+		return
+	}
+	userInfo, err := db.DbService().SelectPrivateUserById(r.Context(), uid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if failed := PWPolicy.Check(pwChangeReq.Password, userInfo.Username, userInfo.Email); len(failed) > 0 {
+		passwordPolicyError(w, r, failed)
+		return
+	}
+	reused, err := passwordReused(r.Context(), uid, pwChangeReq.Password)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if reused {
+		passwordPolicyError(w, r, []string{utils.RuleReused})
 		return
 	}
-	err = db.DbService().NewUserHashById(uid, pwChangeReq.Password)
+	err = db.DbService().NewUserHashById(r.Context(), uid, pwChangeReq.Password)
 	if err != nil {
-		fmt.Println("new user hash returned error")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	db.DbService().DeleteSession(pwChangeReq.Token)
+	// the password is already changed, an unremoved reset token expires on its own
+	err = db.DbService().DeleteSession(r.Context(), pwChangeReq.Token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reset token not removed", "user_id", uid, "error", err)
+	}
 
+	emitEvent(r.Context(), Event{
+		Name:   EventPasswordChanged,
+		UserId: uid,
+		Detail: map[string]any{"reset_token": true},
+	})
 	w.WriteHeader(http.StatusAccepted)
 }
 
-// permanently delete user. ValidateUserCreds required
+// Change password for a logged in user. Requires the current password.
+// With revoke_sessions set, every other refresh token and every API key is
+// removed; the refresh token given in refresh_token is kept so the calling
+// client stays signed in.
+func updatePassword(w http.ResponseWriter, r *http.Request) {
+	var pwUpdateReq struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+		RevokeSessions  bool   `json:"revoke_sessions"`
+		RefreshToken    string `json:"refresh_token"`
+	}
+
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+	if !user.Is(userRequested) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot change another user's password")
+		return
+	}
+
+	err = decodeBody(w, r, &pwUpdateReq)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return
+	}
+
+	auth, err := db.DbService().SelectUserAuthById(r.Context(), user.UserId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	pw_valid, err := verifyPassword(r.Context(), auth.PasswordHash, pwUpdateReq.CurrentPassword)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !pw_valid {
+		writeProblem(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid Credentials")
+		return
+	}
+
+	userInfo, err := db.DbService().SelectPrivateUserById(r.Context(), auth.Id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if failed := PWPolicy.Check(pwUpdateReq.NewPassword, userInfo.Username, userInfo.Email); len(failed) > 0 {
+		passwordPolicyError(w, r, failed)
+		return
+	}
+	reused, err := passwordReused(r.Context(), auth.Id, pwUpdateReq.NewPassword)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if reused {
+		passwordPolicyError(w, r, []string{utils.RuleReused})
+		return
+	}
+
+	err = db.DbService().NewUserHashById(r.Context(), auth.Id, pwUpdateReq.NewPassword)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if pwUpdateReq.RevokeSessions {
+		err = db.DbService().InvalidateOtherSessions(r.Context(), auth.Id, pwUpdateReq.RefreshToken)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		err = db.DbService().DeleteUserApiKeys(r.Context(), auth.Id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	emitEvent(r.Context(), Event{
+		Name:    EventPasswordChanged,
+		UserId:  auth.Id,
+		ActorId: auth.Id,
+		Detail:  map[string]any{"sessions_revoked": pwUpdateReq.RevokeSessions},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete the user's account. ValidateUserCreds required.
+// The account is deactivated now and personal data is erased after
+// DeletionGrace. Logging in before then cancels the deletion.
 func deleteUserAccount(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value("user").(*db.UserAuth)
-	err := db.DbService().DeleteUser(user.Id)
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil || !user.Is(userRequested) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot delete another user's account")
+		return
+	}
+
+	if DeletionGrace <= 0 {
+		err = eraseUser(r.Context(), user.UserId, user.UserId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	deleteAt := time.Now().UTC().Add(DeletionGrace)
+	err = db.DbService().DeactivateUser(r.Context(), user.UserId, &deleteAt)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{
+		Name:    EventDeletionScheduled,
+		UserId:  user.UserId,
+		ActorId: user.UserId,
+		Detail:  map[string]any{"delete_at": deleteAt},
+	})
+	resjson := map[string]time.Time{"deletion_scheduled": deleteAt}
+	utils.WriteJSON(w, resjson, http.StatusAccepted)
+}
+
+// Deactivate the user's own account and remove all sessions.
+// Logging in again reactivates it.
+func deactivateAccount(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil || !user.Is(userRequested) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot deactivate another user's account")
+		return
+	}
+
+	err = db.DbService().DeactivateUser(r.Context(), user.UserId, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	emitEvent(r.Context(), Event{Name: EventAccountDeactivated, UserId: user.UserId, ActorId: user.UserId})
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // JWT test endpoint
 func checkJwt(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value("user").(*utils.TokenClaims)
-	w.Write([]byte(fmt.Sprintf("%d", user.User_id)))
-	w.WriteHeader(200)
+	user := PrincipalFrom(r.Context())
+	if responseType(r) == MediaTypes["JSON"] {
+		utils.WriteJSON(w, map[string]int{"id": user.UserId}, 200)
+		return
+	}
+	utils.WriteText(w, fmt.Sprintf("%d", user.UserId), 200)
 }
 
 // Public Key Endpoint
 func getPublicKey(w http.ResponseWriter, r *http.Request) {
-	pubkeyFile, err := os.ReadFile(os.Getenv("PUB_KEY"))
+	pubkeyFile := utils.Keys.PublicKeyPEM()
+	switch mediaType := responseType(r); mediaType {
+	case MediaTypes["JSON"]:
+		key, _ := utils.Keys.Active()
+		utils.WriteJSON(w, map[string]string{
+			"public_key": string(pubkeyFile),
+			"kid":        key.Id,
+			"alg":        key.Algorithm,
+		}, 200)
+	default:
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(200)
+		w.Write(pubkeyFile)
+	}
+}
+
+// JWK set of every key that verifies tokens, including old keys kept in
+// VERIFY_KEYS during a rotation. Resource servers cache it.
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := utils.Keys.JWKS()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, err)
 		return
 	}
-
-	utils.WriteText(w, string(pubkeyFile), 200)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, set, 200)
 }
 
 //==============================//
 // ---- Handler Extensions ---- //
 //==============================//
 
-// Extends login and refresh routes due to shared functionality
-func newAccess(w http.ResponseWriter, user *db.UserAuth) {
+// Extends login, starting a new session.
+// Tokens from the session are restricted to the grant's audience and scope.
+// With cookie set the refresh token goes in the session cookie instead of the body.
+func newAccess(w http.ResponseWriter, r *http.Request, user *db.UserAuth, grant db.SessionGrant, cookie bool) {
 	if !user.IsActive {
-		http.Error(w, "Account Deactivated", http.StatusForbidden)
+		writeProblem(w, r, http.StatusForbidden, CodeAccountDeactivated, "Account Deactivated")
 		return
 	}
-	newToken, _ := utils.GenerateCryptoString()
-
-	err := db.DbService().NewUserSession(user.Id, newToken, false)
+	newToken, err := utils.GenerateCryptoString()
 	if err != nil {
-		http.Error(w, "New Session Error", 500)
+		writeError(w, r, err)
 		return
 	}
-
-	userClaims := utils.TokenClaims{
-		User_id:  user.Id,
-		Username: user.Username,
-		Is_staff: user.IsStaff,
-		Exp:      time.Now().UTC().Add(time.Minute * 15),
+	err = db.DbService().NewUserSession(r.Context(), user.Id, newToken, false, grant)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	accessToken, err := utils.GenerateAccessToken(&userClaims)
+	sendTokens(w, r, user, grant, newToken, cookie)
+}
+
+// extends newAccess and RefreshAccess
+// Sign an access token and respond with it and the session's refresh token.
+func sendTokens(w http.ResponseWriter, r *http.Request, user *db.UserAuth, grant db.SessionGrant, newToken string, cookie bool) {
+	accessToken, err := issueAccessToken(r.Context(), user, grant, time.Now().UTC().Add(time.Minute*15))
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, err)
 		return
 	}
 	userTokens := tokenResponse{
 		AccessToken:  accessToken,
 		RefreshToken: newToken,
+		Scope:        grant.Scope,
 	}
-	err = db.DbService().UpdateUserLoginTime(user.Id)
+	err = db.DbService().UpdateUserLoginTime(r.Context(), user.Id)
 	if err != nil {
-		http.Error(w, "Update Time Failed", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	if cookie {
+		setSessionCookies(w, newToken)
+		userTokens.RefreshToken = ""
+		userTokens.CsrfToken = csrfToken(newToken)
+	}
 	w.Header().Add("Content-Location", fmt.Sprintf("/user/%d", user.Id))
 	utils.WriteJSON(w, userTokens, 201)
 }
 
-// extends modifyUser
-// validateMapKeys checks if the map keys are valid based on the struct fields.
-func validateMap(m map[string]any, s any) bool {
-	v := reflect.TypeOf(s)
-	for key := range m {
-		_, fieldFound := v.FieldByName(key)
-		if !fieldFound {
-			return false
+// extends createUser and changePassword
+// Lists every password rule that failed so the client can show them all at once.
+func passwordPolicyError(w http.ResponseWriter, r *http.Request, failed []string) {
+	sendProblem(w, r, &utils.Problem{
+		Title:       "Password does not meet policy",
+		Status:      http.StatusUnprocessableEntity,
+		Code:        CodePasswordPolicy,
+		FailedRules: failed,
+	})
+}
+
+// extends changePassword
+// Checks the new password against the user's last PWPolicy.History passwords.
+func passwordReused(ctx context.Context, uid int, password string) (bool, error) {
+	if PWPolicy.History <= 0 {
+		return false, nil
+	}
+	history, err := db.DbService().SelectPasswordHistory(ctx, uid, PWPolicy.History)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range history {
+		match, err := verifyPassword(ctx, hash, password)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extends listUsers and adminListUsers
+// Reads the search filters, keyset cursor and page size from the query string.
+func parseUserFilter(r *http.Request) (db.UserFilter, int, error) {
+	q := r.URL.Query()
+	filter := db.UserFilter{
+		Query:   q.Get("query"),
+		Country: strings.ToUpper(q.Get("country")),
+	}
+	limit := 50
+
+	if v := q.Get("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid value for active")
+		}
+		filter.Active = &active
+	}
+	if v := q.Get("joined_after"); v != "" {
+		joined, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			joined, err = time.Parse(time.DateOnly, v)
+		}
+		if err != nil {
+			return filter, 0, fmt.Errorf("joined_after must be RFC 3339 or YYYY-MM-DD")
 		}
+		filter.JoinedAfter = &joined
+	}
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid cursor")
+		}
+		filter.AfterId = id
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			return filter, 0, fmt.Errorf("limit must be between 1 and 200")
+		}
+		limit = n
+	}
+	return filter, limit, nil
+}
+
+// Write a page of users with the cursor for the next page.
+// next_cursor is null on the last page.
+func writeUserPage[T any](w http.ResponseWriter, users []T, limit int, idAt func(int) int) {
+	var next *string
+	if len(users) == limit {
+		cursor := encodeCursor(idAt(len(users) - 1))
+		next = &cursor
+	}
+	if users == nil {
+		users = []T{}
+	}
+	resjson := struct {
+		Users      []T     `json:"users"`
+		NextCursor *string `json:"next_cursor"`
+	}{users, next}
+	utils.WriteJSON(w, resjson, 200)
+}
+
+// Cursors are opaque to clients, they hold the last user id of a page
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
 	}
-	return true
+	return strconv.Atoi(string(b))
 }
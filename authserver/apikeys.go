@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+const (
+	EventApiKeyCreated = "api_key_created"
+	EventApiKeyRevoked = "api_key_revoked"
+)
+
+// Check an API key from the Authorization header and build its principal.
+// Writes the error response and returns false if the key is refused.
+func authenticateApiKey(w http.ResponseWriter, r *http.Request, key string) (*Principal, bool) {
+	prefix, ok := utils.ParseApiKey(key)
+	if !ok {
+		writeProblem(w, r, http.StatusUnauthorized, CodeApiKeyInvalid, "Malformed API key")
+		return nil, false
+	}
+	stored, err := db.DbService().SelectApiKeyAuth(r.Context(), prefix)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !utils.ApiKeyMatches(key, stored.KeyHash)) {
+		writeProblem(w, r, http.StatusUnauthorized, CodeApiKeyInvalid, "Invalid API key")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	if stored.Expires != nil && stored.Expires.Before(time.Now()) {
+		writeProblem(w, r, http.StatusUnauthorized, CodeApiKeyExpired, "API key has expired")
+		return nil, false
+	}
+	if !ipAllowed(stored.AllowedIPs, r.RemoteAddr) {
+		writeProblem(w, r, http.StatusForbidden, CodeIPNotAllowed, "API key is not allowed from this address")
+		return nil, false
+	}
+	if !stored.IsActive {
+		writeProblem(w, r, http.StatusForbidden, CodeAccountDeactivated, "Account Deactivated")
+		return nil, false
+	}
+	if err := db.DbService().TouchApiKey(r.Context(), stored.Id); err != nil {
+		slog.ErrorContext(r.Context(), "api key last used update failed", "api_key_id", stored.Id, "error", err)
+	}
+	return apiKeyPrincipal(stored), true
+}
+
+// An empty allowlist allows any address
+func ipAllowed(allowed []string, remoteAddr string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, cidr := range allowed {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// request JSON for a new API key
+type newApiKey struct {
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Expires    *time.Time `json:"expires"`
+	AllowedIPs []string   `json:"allowed_ips"`
+}
+
+// The key is only ever returned here
+type createdApiKey struct {
+	db.ApiKey
+	Key string `json:"key"`
+}
+
+// Mint an API key for the user. Keys need at least one of the API's scopes
+// and can't have a scope the caller lacks. Minted with a key, they can't
+// outlive it or be used from addresses it can't, so a scoped token or key
+// only mints narrower keys.
+func createApiKey(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil || !user.Is(userRequested) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot create keys for another user")
+		return
+	}
+
+	var req newApiKey
+	err = decodeBody(w, r, &req)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return
+	}
+	key := db.ApiKey{UserId: user.UserId, Name: strings.TrimSpace(req.Name), Expires: req.Expires}
+	errs := fieldErrors{}
+	if n := utf8.RuneCountInString(key.Name); n == 0 || n > 50 {
+		errs["name"] = "must be 1 to 50 characters"
+	}
+	if key.Expires != nil && !key.Expires.After(time.Now()) {
+		errs["expires"] = "must be in the future"
+	}
+	key.AllowedIPs, err = parseAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		errs["allowed_ips"] = err.Error()
+	}
+	// a key minting a key passes on its own expiry and allowlist
+	if caller := user.ApiKey; caller != nil {
+		if key.Expires == nil {
+			key.Expires = caller.Expires
+		} else if caller.Expires != nil && key.Expires.After(*caller.Expires) {
+			errs["expires"] = "must not be later than the expiry of the key making the request"
+		}
+		if len(key.AllowedIPs) == 0 {
+			key.AllowedIPs = caller.AllowedIPs
+		} else if err == nil && !prefixesWithin(key.AllowedIPs, caller.AllowedIPs) {
+			errs["allowed_ips"] = "must be within the allowed_ips of the key making the request"
+		}
+	}
+	if len(errs) > 0 {
+		validationError(w, r, errs)
+		return
+	}
+
+	scopes := []string{}
+	for _, scope := range strings.Fields(req.Scope) {
+		detail := ""
+		switch {
+		case !slices.Contains(apiScopes, scope):
+			detail = fmt.Sprintf("Unknown scope %q", scope)
+		case scope == ScopeAdmin && !user.IsStaff:
+			detail = "The admin scope is only granted to staff"
+		case !user.HasScope(scope):
+			detail = fmt.Sprintf("You do not have the %s scope", scope)
+		}
+		if detail != "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidScope, detail)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidScope, "API keys need at least one scope")
+		return
+	}
+	key.Scope = strings.Join(scopes, " ")
+
+	secret, prefix, err := utils.GenerateApiKey()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	key.Prefix = prefix
+	err = db.DbService().InsertApiKey(r.Context(), &key, utils.HashApiKey(secret))
+	if errors.Is(err, db.ErrApiKeyNameTaken) {
+		writeProblem(w, r, http.StatusConflict, CodeConflict, "You already have a key with this name")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{
+		Name:    EventApiKeyCreated,
+		UserId:  key.UserId,
+		ActorId: user.UserId,
+		Detail:  map[string]any{"api_key_id": key.Id, "name": key.Name, "prefix": key.Prefix, "scope": key.Scope},
+	})
+	w.Header().Set("Location", fmt.Sprintf("/user/%d/apikeys/%d", key.UserId, key.Id))
+	utils.WriteJSON(w, createdApiKey{key, secret}, http.StatusCreated)
+}
+
+// Single addresses become /32 or /128 prefixes
+func parseAllowedIPs(values []string) ([]string, error) {
+	prefixes := []string{}
+	for _, v := range values {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR prefix", v)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked().String())
+	}
+	return prefixes, nil
+}
+
+// Reports whether every prefix lies inside one of outer. An empty outer
+// allows any address.
+func prefixesWithin(prefixes, outer []string) bool {
+	if len(outer) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		inner := netip.MustParsePrefix(p)
+		if !slices.ContainsFunc(outer, func(o string) bool {
+			prefix, err := netip.ParsePrefix(o)
+			return err == nil && prefix.Bits() <= inner.Bits() && prefix.Contains(inner.Addr())
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// List the user's keys without their secrets. Self or staff.
+func listApiKeys(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+	if !user.Is(userRequested) && !user.IsStaff {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot view another user's keys")
+		return
+	}
+	if !user.Is(userRequested) && !superuserTargetAllowed(w, r, userRequested) {
+		return
+	}
+	keys, err := db.DbService().SelectApiKeys(r.Context(), userRequested)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	utils.WriteJSON(w, keys, http.StatusOK)
+}
+
+// Revoke a key. Self or staff. Takes effect on the key's next request.
+func revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return
+	}
+	if !user.Is(userRequested) && !user.IsStaff {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot revoke another user's keys")
+		return
+	}
+	if !user.Is(userRequested) && !superuserTargetAllowed(w, r, userRequested) {
+		return
+	}
+	keyId, err := strconv.Atoi(chi.URLParam(r, "key_id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "API key not found")
+		return
+	}
+	key, err := db.DbService().DeleteApiKey(r.Context(), userRequested, keyId)
+	if errors.Is(err, db.ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitEvent(r.Context(), Event{
+		Name:    EventApiKeyRevoked,
+		UserId:  key.UserId,
+		ActorId: user.UserId,
+		Detail:  map[string]any{"api_key_id": key.Id, "name": key.Name, "prefix": key.Prefix},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,27 +4,41 @@ import (
 	"authapi/db"
 	"authapi/utils"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/go-chi/chi/v5"
 )
 
+// Require an access token, or an API key sent as "Authorization: ApiKey ..."
 func TokenRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scheme, key, _ := strings.Cut(r.Header.Get("Authorization"), " "); scheme == "ApiKey" {
+			principal, ok := authenticateApiKey(w, r, key)
+			if !ok {
+				return
+			}
+			r = logUser(r, principal.UserId)
+			ctx := utils.WithLogAttrs(r.Context(), slog.Int("api_key_id", principal.ApiKey.Id))
+			next.ServeHTTP(w, r.WithContext(withPrincipal(ctx, principal)))
+			return
+		}
 		tokenClaims, err := TokenVerify(r)
 		if err != nil {
-			errtxt := err.Error()
-			if errtxt == "header missing" || errtxt == "invalid" {
-				http.Error(w, errtxt, 400)
-			} else if errtxt == "expired" {
-				http.Error(w, errtxt, http.StatusUnauthorized)
-			} else {
-				http.Error(w, err.Error(), 500)
-			}
+			writeError(w, r, err)
 			return
 		}
-		ctx := context.WithValue(r.Context(), "user", tokenClaims)
+		// tokens issued for other services are not valid here
+		if !TokenGrants.forAPI(tokenClaims) {
+			writeProblem(w, r, http.StatusUnauthorized, CodeTokenInvalid, "Token is for another audience")
+			return
+		}
+		r = logUser(r, tokenClaims.User_id)
+		ctx := withPrincipal(r.Context(), tokenPrincipal(tokenClaims))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -33,12 +47,12 @@ func TokenVerify(r *http.Request) (*utils.TokenClaims, error) {
 	authHeaderString := r.Header.Get("Authorization")
 
 	if authHeaderString == "" {
-		return nil, fmt.Errorf("header missing")
+		return nil, utils.ErrTokenMissing
 	}
 
 	headerVal := strings.Split(strings.TrimSpace(authHeaderString), " ")
 	if len(headerVal) != 2 || headerVal[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid")
+		return nil, fmt.Errorf("%w: expected a Bearer token", utils.ErrTokenInvalid)
 	}
 
 	tokenClaims, err := utils.ValidateAccessToken(headerVal[1])
@@ -48,14 +62,15 @@ func TokenVerify(r *http.Request) (*utils.TokenClaims, error) {
 	return tokenClaims, nil
 }
 
-// Staff and Superuser checks can be used seperate from each other, but both rely on TokenVerify first
+// Staff and Superuser checks can be used seperate from each other, but both rely on TokenVerify first.
+// Anonymous requests fail both.
 
 // Staff permission check. Placed after TokenVerify
 func StaffRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userClaim := r.Context().Value("user").(*utils.TokenClaims)
-		if !userClaim.Is_staff {
-			http.Error(w, "Access Forbidden", http.StatusForbidden)
+		caller := PrincipalFrom(r.Context())
+		if !caller.IsStaff {
+			writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Access Forbidden")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -66,53 +81,110 @@ func StaffRequired(next http.Handler) http.Handler {
 // This middleware function is intended to be placed after TokenVerify in routes.
 func SuperUserVerify(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userClaim := r.Context().Value("user").(*utils.TokenClaims)
-		user, _ := db.DbService().SelectUserAuth(userClaim.Username)
-		if !user.IsActive || !user.IsSuperuser {
-			http.Error(w, "Not Authorized", http.StatusForbidden)
+		if !isSuperuser(r.Context(), PrincipalFrom(r.Context())) {
+			writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Not Authorized")
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Reports whether the caller is an active superuser, looked up by id so a
+// rename since the token was issued can't point at another account
+func isSuperuser(ctx context.Context, caller *Principal) bool {
+	if caller.IsAnonymous() {
+		return false
+	}
+	user, err := db.DbService().SelectUserAuthById(ctx, caller.UserId)
+	return err == nil && user.IsActive && user.IsSuperuser
+}
+
+// For staff acting on another user outside /admin. Writes the response and
+// returns false when the target is a superuser and the caller is not.
+func superuserTargetAllowed(w http.ResponseWriter, r *http.Request, targetId int) bool {
+	target, err := db.DbService().SelectUserAuthById(r.Context(), targetId)
+	if errors.Is(err, db.ErrNotFound) {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "User Not Found")
+		return false
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if target.IsSuperuser && !isSuperuser(r.Context(), PrincipalFrom(r.Context())) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Not Authorized")
+		return false
+	}
+	return true
+}
+
+// Load the user targeted by an admin route, read back with targetFrom.
+// Only superusers may act on superuser accounts. Placed after StaffRequired.
+func AdminTargetCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetId, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, CodeNotFound, "User Not Found")
+			return
+		}
+		target, err := db.DbService().SelectUserAuthById(r.Context(), targetId)
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, CodeNotFound, "User Not Found")
+			return
+		}
+		if target.IsSuperuser && !isSuperuser(r.Context(), PrincipalFrom(r.Context())) {
+			writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Not Authorized")
+			return
+		}
+		ctx := context.WithValue(r.Context(), targetKey{}, target)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // Username and Login handler for Logining in user and deleting user
 func validateUserCreds(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
-
-		dec := json.NewDecoder(r.Body)
-		dec.DisallowUnknownFields()
-
 		var u userCreds
-		err := dec.Decode(&u)
+		err := decodeBody(w, r, &u)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
 			return
 		}
-		user, err := db.DbService().SelectUserAuth(u.Username)
-		if err != nil {
-			fmt.Println("Username Failed", err)
-			http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+		if u.GrantType != "" && u.GrantType != "password" {
+			writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "grant_type must be password")
+			return
+		}
+		user, err := db.DbService().SelectUserAuth(r.Context(), u.Username)
+		// erased accounts can't be logged into, whatever their password
+		if err != nil || user.AnonymizedAt != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid Credentials")
 			return
 		}
 
 		if user.PasswordHash == "" {
-			http.Error(w, "Password Change Needed", http.StatusConflict)
+			writeProblem(w, r, http.StatusConflict, CodePasswordChangeRequired, "Password Change Needed")
 			return
 		}
 
-		pw_valid, err := utils.VerifyPassword(user.PasswordHash, u.Password)
+		pw_valid, err := verifyPassword(r.Context(), user.PasswordHash, u.Password)
 		if err != nil {
-			fmt.Println(err.Error())
-			http.Error(w, "Credential Validation Error", http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		if !pw_valid {
-			http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid Credentials")
 			return
 		}
-		ctx := context.WithValue(r.Context(), "user", user)
+		// upgrade hashes made with an older algorithm or cost while the plain password is known
+		if utils.NeedsRehash(user.PasswordHash) {
+			err = db.DbService().RehashUserPassword(r.Context(), user.Id, u.Password)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "rehash failed", "user_id", user.Id, "error", err)
+			}
+		}
+		r = logUser(r, user.Id)
+		ctx := withPrincipal(r.Context(), accountPrincipal(user))
+		ctx = context.WithValue(ctx, tokenRequestKey{}, db.SessionGrant{Audience: u.Audience, Scope: u.Scope})
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
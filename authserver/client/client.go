@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"authapi/utils"
+)
+
+// Claims of an access token from the auth server
+type TokenClaims = utils.TokenClaims
+
+// Returned when there is no session to use, before Login or after a
+// refresh was refused
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// A problem response from the auth server. Match on Code, see the README.
+type Error struct {
+	utils.Problem
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("authapi: %d %s: %s", e.Status, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("authapi: %d %s", e.Status, e.Code)
+}
+
+// Session with the auth server for one user. Access tokens are refreshed
+// before they expire, one refresh at a time, so concurrent callers never
+// present a rotated refresh token and revoke the session. Safe for
+// concurrent use.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Sent on Login to restrict the session's tokens
+	Audience string
+	Scope    string
+	// Access tokens are refreshed this long before they expire
+	RefreshLeeway time.Duration
+
+	mu      sync.Mutex
+	access  string
+	refresh string
+	expires time.Time
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:       strings.TrimRight(baseURL, "/"),
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+		RefreshLeeway: 30 * time.Second,
+	}
+}
+
+type tokenResponse struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+// Start a session with username and password
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	body := map[string]string{"username": username, "password": password}
+	if c.Audience != "" {
+		body["audience"] = c.Audience
+	}
+	if c.Scope != "" {
+		body["scope"] = c.Scope
+	}
+	var tokens tokenResponse
+	if err := c.call(ctx, http.MethodPost, "/session", "", body, &tokens); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setTokens(tokens)
+	return nil
+}
+
+// Rotate the refresh token and get a new access token now
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+// End the session on the server and forget its tokens. The server accepts
+// an expired access token here. If it refuses, the tokens are kept so the
+// logout can be tried again.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refresh == "" {
+		return ErrNotLoggedIn
+	}
+	err := c.call(ctx, http.MethodDelete, "/session", c.access, map[string]string{"refresh_token": c.refresh}, nil)
+	if err != nil {
+		return err
+	}
+	c.setTokens(tokenResponse{})
+	return nil
+}
+
+// A current access token, refreshed first if it is about to expire
+func (c *Client) AccessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refresh == "" {
+		return "", ErrNotLoggedIn
+	}
+	if time.Until(c.expires) < c.RefreshLeeway {
+		if err := c.refreshLocked(ctx); err != nil {
+			return "", err
+		}
+	}
+	return c.access, nil
+}
+
+// Send req with the access token. A 401 answer gets one retry with a
+// refreshed token, as long as the body can be sent again.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	access, err := c.AccessToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.send(req, access)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+
+	c.mu.Lock()
+	// a concurrent request may have refreshed already
+	if c.access == access {
+		err = c.refreshLocked(req.Context())
+	}
+	access = c.access
+	c.mu.Unlock()
+	if err != nil {
+		return res, nil
+	}
+	res.Body.Close()
+	if req.GetBody != nil {
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.send(req, access)
+}
+
+func (c *Client) send(req *http.Request, access string) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+access)
+	return c.HTTPClient.Do(req)
+}
+
+// Must hold c.mu. A refused refresh ends the session.
+func (c *Client) refreshLocked(ctx context.Context) error {
+	if c.refresh == "" {
+		return ErrNotLoggedIn
+	}
+	var tokens tokenResponse
+	err := c.call(ctx, http.MethodPost, "/session/refresh", c.access,
+		map[string]string{"refresh_token": c.refresh}, &tokens)
+	var problem *Error
+	if errors.As(err, &problem) && problem.Status == http.StatusUnauthorized {
+		c.setTokens(tokenResponse{})
+		return fmt.Errorf("%w: %w", ErrNotLoggedIn, err)
+	}
+	if err != nil {
+		return err
+	}
+	c.setTokens(tokens)
+	return nil
+}
+
+// Must hold c.mu
+func (c *Client) setTokens(tokens tokenResponse) {
+	c.access = tokens.AccessToken
+	c.refresh = tokens.RefreshToken
+	c.expires = tokenExpiry(tokens.AccessToken)
+}
+
+// JSON request to the auth server, decoding the response into out
+func (c *Client) call(ctx context.Context, method, path, access string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		problem := &Error{}
+		if json.NewDecoder(res.Body).Decode(&problem.Problem) != nil || problem.Code == "" {
+			problem.Status = res.StatusCode
+			problem.Code = "unexpected_response"
+		}
+		return problem
+	}
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Expiry from the token's claims. The token came from the server, so the
+// signature is not checked; a token that can't be read counts as expired.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims TokenClaims
+	if json.Unmarshal(payload, &claims) != nil {
+		return time.Time{}
+	}
+	return claims.Exp
+}
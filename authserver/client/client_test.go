@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"authapi/utils"
+)
+
+var testExpiry = time.Now().Add(15 * time.Minute)
+
+// Unsigned token with an expiry, enough for the client to schedule
+// refreshes. The same n always gives the same token.
+func testAccessToken(t *testing.T, n int) string {
+	t.Helper()
+	payload, err := json.Marshal(utils.TokenClaims{User_id: n, Exp: testExpiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+// Auth server with one session. Every refresh issues a new access token;
+// the resource accepts only the tokens in valid.
+type authServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	issued    int
+	refreshes int
+	resource  int
+	valid     map[string]bool
+	logout    int
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	s := &authServer{valid: map[string]bool{}, logout: http.StatusNoContent}
+	issue := func(w http.ResponseWriter) {
+		s.issued++
+		json.NewEncoder(w).Encode(map[string]string{
+			"AccessToken":  testAccessToken(t, s.issued),
+			"RefreshToken": fmt.Sprintf("refresh-%d", s.issued),
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			issue(w)
+		case http.MethodDelete:
+			if s.logout != http.StatusNoContent {
+				utils.WriteProblem(w, &utils.Problem{Status: s.logout, Code: "unavailable"})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/session/refresh", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.refreshes++
+		issue(w)
+	})
+	mux.HandleFunc("/resource", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.resource++
+		if !s.valid[r.Header.Get("Authorization")] {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Let the resource accept the nth issued access token
+func (s *authServer) accept(t *testing.T, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.valid["Bearer "+testAccessToken(t, n)] = true
+}
+
+func (s *authServer) counts() (refreshes, resource int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes, s.resource
+}
+
+func loggedIn(t *testing.T, s *authServer) *Client {
+	t.Helper()
+	c := New(s.URL)
+	if err := c.Login(context.Background(), "user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRetriesOnceAfter401(t *testing.T) {
+	server := newAuthServer(t)
+	c := loggedIn(t, server)
+	// the login token was revoked, the refreshed one works
+	server.accept(t, 2)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/resource", nil)
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want 200", res.StatusCode)
+	}
+	if refreshes, resource := server.counts(); refreshes != 1 || resource != 2 {
+		t.Errorf("got %d refreshes and %d requests, want 1 and 2", refreshes, resource)
+	}
+}
+
+func TestClientGivesUpAfterOneRetry(t *testing.T) {
+	server := newAuthServer(t)
+	c := loggedIn(t, server)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/resource", nil)
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401", res.StatusCode)
+	}
+	if refreshes, resource := server.counts(); refreshes != 1 || resource != 2 {
+		t.Errorf("got %d refreshes and %d requests, want 1 and 2", refreshes, resource)
+	}
+}
+
+func TestClientLogout(t *testing.T) {
+	server := newAuthServer(t)
+	c := loggedIn(t, server)
+
+	server.mu.Lock()
+	server.logout = http.StatusServiceUnavailable
+	server.mu.Unlock()
+	var problem *Error
+	if err := c.Logout(context.Background()); !errors.As(err, &problem) || problem.Status != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want the server's problem", err)
+	}
+	if _, err := c.AccessToken(context.Background()); err != nil {
+		t.Errorf("refused logout dropped the session: %v", err)
+	}
+
+	server.mu.Lock()
+	server.logout = http.StatusNoContent
+	server.mu.Unlock()
+	if err := c.Logout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AccessToken(context.Background()); !errors.Is(err, ErrNotLoggedIn) {
+		t.Errorf("got %v after logout, want ErrNotLoggedIn", err)
+	}
+}
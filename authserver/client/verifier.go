@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"authapi/utils"
+)
+
+// Verifies access tokens in a resource server with the auth server's
+// public keys. The JWK set is cached for CacheTTL and fetched again early,
+// at most once per MinRefetch, when a token names a key not in it, so a
+// key rotation is picked up without a restart. A failed fetch is not
+// retried for MinRefetch either. Safe for concurrent use.
+type Verifier struct {
+	JWKSURL    string
+	HTTPClient *http.Client
+	// Tokens must be issued for this audience. Empty accepts any audience,
+	// only sensible when the auth server issues no audiences.
+	Audience   string
+	CacheTTL   time.Duration
+	MinRefetch time.Duration
+
+	mu       sync.Mutex
+	keys     map[string]*utils.RingKey
+	fetched  time.Time
+	failed   time.Time
+	fetchErr error
+	inflight *jwksFetch
+}
+
+// A fetch of the JWK set shared by every caller that needs it meanwhile
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// Verifier for tokens from the auth server at baseURL, issued for audience
+func NewVerifier(baseURL, audience string) *Verifier {
+	return &Verifier{
+		JWKSURL:    strings.TrimRight(baseURL, "/") + "/.well-known/jwks.json",
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Audience:   audience,
+		CacheTTL:   5 * time.Minute,
+		MinRefetch: 30 * time.Second,
+	}
+}
+
+// Claims of a valid token. Errors match utils.ErrTokenInvalid or
+// utils.ErrTokenExpired, or are from fetching the keys.
+func (v *Verifier) Verify(ctx context.Context, token string) (*TokenClaims, error) {
+	var fetchErr error
+	lookup := func(kid string) (*utils.RingKey, bool) {
+		var key *utils.RingKey
+		key, fetchErr = v.key(ctx, kid)
+		return key, key != nil
+	}
+	claims, err := utils.ParseAccessToken(token, lookup)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v.Audience != "" && claims.Aud != v.Audience {
+		return nil, fmt.Errorf("%w: token is for another audience", utils.ErrTokenInvalid)
+	}
+	return claims, nil
+}
+
+func (v *Verifier) key(ctx context.Context, kid string) (*utils.RingKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetched)
+	if (ok && age < v.CacheTTL) || (!ok && v.keys != nil && age < v.MinRefetch) {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if time.Since(v.failed) < v.MinRefetch {
+		// the auth server failed moments ago, keep verifying with the cached key
+		err := v.fetchErr
+		v.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	f := v.inflight
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		v.inflight = f
+		// the fetch is shared, so it must not end with this caller's request
+		go v.fetch(context.WithoutCancel(ctx), f)
+	}
+	v.mu.Unlock()
+	if ok {
+		// a known key is used while the set is refreshed in the background
+		return key, nil
+	}
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if cached, ok := v.keys[kid]; ok || f.err == nil {
+		return cached, nil
+	}
+	return nil, f.err
+}
+
+// Fetch the JWK set without holding v.mu, then store it or the failure
+func (v *Verifier) fetch(ctx context.Context, f *jwksFetch) {
+	keys, err := v.fetchKeys(ctx)
+	v.mu.Lock()
+	if err != nil {
+		v.failed, v.fetchErr = time.Now(), err
+	} else {
+		v.keys, v.fetched = keys, time.Now()
+	}
+	v.inflight = nil
+	f.err = err
+	v.mu.Unlock()
+	close(f.done)
+}
+
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]*utils.RingKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks: status %d", res.StatusCode)
+	}
+	var set utils.JWKSet
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+	keys := make(map[string]*utils.RingKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.RingKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[key.Id] = key
+	}
+	return keys, nil
+}
+
+//======================//
+// ---- Middleware ---- //
+//======================//
+
+type claimsKey struct{}
+
+// Claims put in the context by Verifier.Middleware
+func ClaimsFromContext(ctx context.Context) (*TokenClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*TokenClaims)
+	return claims, ok
+}
+
+// Context carrying claims, as Verifier.Middleware makes. Useful in tests.
+func WithClaims(ctx context.Context, claims *TokenClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// Require a valid bearer token, putting its claims in the request context
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || scheme != "Bearer" || token == "" {
+			unauthorized(w, "token_missing")
+			return
+		}
+		claims, err := v.Verify(r.Context(), token)
+		switch {
+		case errors.Is(err, utils.ErrTokenExpired):
+			unauthorized(w, "token_expired")
+		case errors.Is(err, utils.ErrTokenInvalid):
+			unauthorized(w, "token_invalid")
+		case err != nil:
+			utils.WriteProblem(w, &utils.Problem{
+				Status: http.StatusServiceUnavailable,
+				Code:   "keys_unavailable",
+			})
+		default:
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		}
+	})
+}
+
+// Refuse tokens without the scope. Placed after Verifier.Middleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok || !claims.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+				utils.WriteProblem(w, &utils.Problem{
+					Status: http.StatusForbidden,
+					Code:   "insufficient_scope",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, code string) {
+	if code == "token_missing" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	utils.WriteProblem(w, &utils.Problem{
+		Status: http.StatusUnauthorized,
+		Code:   code,
+	})
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"authapi/utils"
+)
+
+// Signing key with the ring key the auth server would publish for it
+type testKey struct {
+	signer utils.Signer
+	ring   *utils.RingKey
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := utils.NewSigner(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := utils.NewVerifier(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, err := utils.KeyId(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := &utils.RingKey{Id: kid, Algorithm: utils.AlgEdDSA, Public: priv.Public(), Verifier: verifier}
+	return testKey{signer, ring}
+}
+
+func (k testKey) token(t *testing.T, claims utils.TokenClaims) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	head := encode(map[string]string{"alg": k.ring.Algorithm, "typ": "JWT", "kid": k.ring.Id}) + "." + encode(claims)
+	sig, err := k.signer.Sign(context.Background(), []byte(head))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// JWKS endpoint counting fetches. The served keys and status can be
+// changed between requests.
+type jwksServer struct {
+	*httptest.Server
+	hits atomic.Int32
+
+	mu     sync.Mutex
+	keys   []testKey
+	status int
+	delay  time.Duration
+}
+
+func newJWKSServer(t *testing.T, keys ...testKey) *jwksServer {
+	s := &jwksServer{keys: keys, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		s.mu.Lock()
+		keys, status, delay := s.keys, s.status, s.delay
+		s.mu.Unlock()
+		time.Sleep(delay)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		set := utils.JWKSet{Keys: []utils.JWK{}}
+		for _, key := range keys {
+			jwk, err := utils.NewJWK(key.ring)
+			if err != nil {
+				t.Error(err)
+			}
+			set.Keys = append(set.Keys, jwk)
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, keys ...testKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.keys = status, keys
+}
+
+func newTestVerifier(s *jwksServer) *Verifier {
+	v := NewVerifier(s.URL, "")
+	v.JWKSURL = s.URL
+	v.CacheTTL = time.Hour
+	v.MinRefetch = time.Minute
+	return v
+}
+
+func validClaims() utils.TokenClaims {
+	return utils.TokenClaims{User_id: 1, Username: "user", Exp: time.Now().Add(time.Minute)}
+}
+
+func TestVerifierUnknownKidRefetches(t *testing.T) {
+	first, second := newTestKey(t), newTestKey(t)
+	server := newJWKSServer(t, first)
+	v := newTestVerifier(server)
+
+	if _, err := v.Verify(context.Background(), first.token(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	server.set(http.StatusOK, first, second)
+	token := second.token(t, validClaims())
+	if _, err := v.Verify(context.Background(), token); !errors.Is(err, utils.ErrTokenInvalid) {
+		t.Errorf("unknown kid within MinRefetch: got %v, want ErrTokenInvalid", err)
+	}
+	if hits := server.hits.Load(); hits != 1 {
+		t.Fatalf("refetched within MinRefetch, %d fetches", hits)
+	}
+
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-2 * v.MinRefetch)
+	v.mu.Unlock()
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if _, err := v.Verify(context.Background(), newTestKey(t).token(t, validClaims())); !errors.Is(err, utils.ErrTokenInvalid) {
+		t.Errorf("key missing after the refetch: got %v, want ErrTokenInvalid", err)
+	}
+	if hits := server.hits.Load(); hits != 2 {
+		t.Errorf("got %d fetches, want 2", hits)
+	}
+}
+
+func TestVerifierSharesFetch(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer(t, key)
+	server.delay = 50 * time.Millisecond
+	v := newTestVerifier(server)
+	token := key.token(t, validClaims())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Verify(context.Background(), token); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if hits := server.hits.Load(); hits != 1 {
+		t.Errorf("got %d fetches for concurrent verifications, want 1", hits)
+	}
+}
+
+func TestVerifierFailedFetchBacksOff(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer(t, key)
+	server.set(http.StatusInternalServerError, key)
+	v := newTestVerifier(server)
+	token := key.token(t, validClaims())
+
+	for i := 0; i < 3; i++ {
+		_, err := v.Verify(context.Background(), token)
+		if err == nil || errors.Is(err, utils.ErrTokenInvalid) {
+			t.Fatalf("got %v, want the fetch error", err)
+		}
+	}
+	if hits := server.hits.Load(); hits != 1 {
+		t.Fatalf("failed fetch retried within MinRefetch, %d fetches", hits)
+	}
+
+	server.set(http.StatusOK, key)
+	v.mu.Lock()
+	v.failed = time.Now().Add(-2 * v.MinRefetch)
+	v.mu.Unlock()
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("after MinRefetch: %v", err)
+	}
+	if hits := server.hits.Load(); hits != 2 {
+		t.Errorf("got %d fetches, want 2", hits)
+	}
+}
+
+func TestVerifierAudience(t *testing.T) {
+	key := newTestKey(t)
+	v := newTestVerifier(newJWKSServer(t, key))
+	v.Audience = "reports"
+
+	claims := validClaims()
+	claims.Aud = "billing"
+	if _, err := v.Verify(context.Background(), key.token(t, claims)); !errors.Is(err, utils.ErrTokenInvalid) {
+		t.Errorf("token for another audience: got %v, want ErrTokenInvalid", err)
+	}
+	claims.Aud = "reports"
+	if _, err := v.Verify(context.Background(), key.token(t, claims)); err != nil {
+		t.Error(err)
+	}
+	claims.Exp = time.Now().Add(-time.Minute)
+	if _, err := v.Verify(context.Background(), key.token(t, claims)); !errors.Is(err, utils.ErrTokenExpired) {
+		t.Errorf("expired token: got %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestVerifierMiddleware(t *testing.T) {
+	key := newTestKey(t)
+	v := newTestVerifier(newJWKSServer(t, key))
+	claims := validClaims()
+	claims.Scope = "profile:read"
+	handler := v.Middleware(RequireScope("profile:read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, ok := ClaimsFromContext(r.Context()); !ok || got.User_id != claims.User_id {
+			t.Errorf("got claims %v", got)
+		}
+	})))
+
+	for name, tc := range map[string]struct {
+		header string
+		status int
+	}{
+		"no token":    {"", http.StatusUnauthorized},
+		"bad token":   {"Bearer not.a.token", http.StatusUnauthorized},
+		"valid token": {"Bearer " + key.token(t, claims), http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: got %d, want %d", name, rec.Code, tc.status)
+		}
+	}
+
+	claims.Scope = "profile:write"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+key.token(t, claims))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+		t.Errorf("missing scope: got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
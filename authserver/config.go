@@ -1,13 +1,48 @@
 package main
 
-var ORIGINS []string = []string{}
+import (
+	"time"
+
+	"authapi/utils"
+)
 
 var METHODS []string = []string{
 	"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS",
 }
 
 var MediaTypes = map[string]string{
-	"JSON": "application/json",
-	"text": "text/html",
-	"form": "multipart/form-data",
+	"JSON":        "application/json",
+	"problem":     "application/problem+json",
+	"text":        "text/plain",
+	"html":        "text/html",
+	"pem":         "application/x-pem-file",
+	"zip":         "application/zip",
+	"merge-patch": "application/merge-patch+json",
+	"form":        "application/x-www-form-urlencoded",
 }
+
+// Cross origin policies, loaded from the environment at startup
+var CORS CORSConfig
+
+// Cookie based browser sessions, off unless SESSION_COOKIES is set
+var SessionCookies SessionCookieConfig
+
+// Audiences and scopes tokens may be issued for, loaded from the environment at startup
+var TokenGrants TokenGrantConfig
+
+// Password rules applied on registration and password change.
+// Loaded from the environment at startup.
+var PWPolicy utils.PasswordPolicy
+
+// Time between a user deleting their account and their data being erased.
+// Logging in during this time cancels the deletion.
+var DeletionGrace time.Duration
+
+// How often the erasure worker looks for accounts past their grace period
+var ErasureInterval time.Duration
+
+// Users with more audit events than this get their data export built in the background
+var ExportSyncMaxEvents int
+
+// Finished background exports are kept in memory for this long
+var ExportRetention time.Duration
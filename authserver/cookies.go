@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+// Browser session mode.
+// Logging in with ?mode=cookie sets the refresh token as an HttpOnly cookie
+// scoped to /session, so it is never readable by page scripts. The access
+// token is still returned in the body. Cookie authenticated requests must
+// echo the CSRF token in the X-CSRF-Token header.
+const (
+	refreshCookie     = "refresh_token"
+	csrfCookie        = "csrf_token"
+	csrfHeader        = "X-CSRF-Token"
+	refreshCookiePath = "/session"
+)
+
+type SessionCookieConfig struct {
+	Enabled  bool
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+
+	// Key for deriving CSRF tokens from refresh tokens
+	CSRFKey []byte
+}
+
+func SessionCookieConfigFromEnv() (SessionCookieConfig, error) {
+	c := SessionCookieConfig{
+		Enabled: utils.EnvBool("SESSION_COOKIES", false),
+		Secure:  utils.EnvBool("SESSION_COOKIE_SECURE", true),
+		Domain:  os.Getenv("SESSION_COOKIE_DOMAIN"),
+	}
+	switch strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")) {
+	case "", "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "lax":
+		c.SameSite = http.SameSiteLaxMode
+	case "none":
+		// browsers drop SameSite=None cookies that are not Secure
+		if !c.Secure {
+			return c, fmt.Errorf("SESSION_COOKIE_SAMESITE=none requires SESSION_COOKIE_SECURE")
+		}
+		c.SameSite = http.SameSiteNoneMode
+	default:
+		return c, fmt.Errorf("SESSION_COOKIE_SAMESITE must be strict, lax or none")
+	}
+
+	// shared by every instance, a random key per process would break CSRF
+	// tokens across replicas and restarts
+	c.CSRFKey = []byte(os.Getenv("CSRF_KEY"))
+	if c.Enabled && len(c.CSRFKey) == 0 {
+		return c, fmt.Errorf("SESSION_COOKIES requires CSRF_KEY")
+	}
+	return c, nil
+}
+
+// Reports whether a login asked for a cookie session
+func wantsCookieSession(r *http.Request) bool {
+	return SessionCookies.Enabled && r.URL.Query().Get("mode") == "cookie"
+}
+
+// CSRF tokens are an HMAC of the refresh token, so they rotate with it and
+// cannot be forged by planting a cookie without the key.
+func csrfToken(refresh string) string {
+	mac := hmac.New(sha256.New, SessionCookies.CSRFKey)
+	mac.Write([]byte(refresh))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validCSRF(r *http.Request, refresh string) bool {
+	given := r.Header.Get(csrfHeader)
+	return given != "" && hmac.Equal([]byte(given), []byte(csrfToken(refresh)))
+}
+
+// Set the refresh cookie and the CSRF cookie. The CSRF cookie is readable by
+// scripts so a reloaded page can still send the header.
+func setSessionCookies(w http.ResponseWriter, refresh string) {
+	maxAge := int(db.RefreshTokenLifetime.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refresh,
+		Path:     refreshCookiePath,
+		Domain:   SessionCookies.Domain,
+		MaxAge:   maxAge,
+		Secure:   SessionCookies.Secure,
+		HttpOnly: true,
+		SameSite: SessionCookies.SameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrfToken(refresh),
+		Path:     "/",
+		Domain:   SessionCookies.Domain,
+		MaxAge:   maxAge,
+		Secure:   SessionCookies.Secure,
+		SameSite: SessionCookies.SameSite,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, c := range []struct{ name, path string }{
+		{refreshCookie, refreshCookiePath},
+		{csrfCookie, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.name,
+			Path:     c.path,
+			Domain:   SessionCookies.Domain,
+			MaxAge:   -1,
+			Secure:   SessionCookies.Secure,
+			HttpOnly: c.name == refreshCookie,
+			SameSite: SessionCookies.SameSite,
+		})
+	}
+}
+
+// extends RefreshAccess and logoutUser
+// Reads the refresh token from the session cookie, checking the CSRF header,
+// or from the request body. fromCookie reports where it came from.
+// Writes the error response and returns ok false on failure.
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (token string, fromCookie bool, ok bool) {
+	if SessionCookies.Enabled {
+		if c, err := r.Cookie(refreshCookie); err == nil && c.Value != "" {
+			if !validCSRF(r, c.Value) {
+				writeProblem(w, r, http.StatusForbidden, CodeCSRFFailed, "Missing or invalid CSRF token")
+				return "", true, false
+			}
+			return c.Value, true, true
+		}
+	}
+
+	var refresh refreshToken
+	err := decodeBody(w, r, &refresh)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return "", false, false
+	}
+	if refresh.GrantType != "" && refresh.GrantType != "refresh_token" {
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "grant_type must be refresh_token")
+		return "", false, false
+	}
+	return refresh.Token, false, true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/cors"
+
+	"authapi/utils"
+)
+
+// Cross origin policy for browser clients.
+// Public routes (countries, public key) allow any origin without credentials.
+// Every other route only allows the configured origins, with credentials so
+// cookie sessions work.
+type CORSConfig struct {
+	// Exact origins or wildcard subdomains, e.g. https://*.example.com
+	Origins        []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	MaxAge         int // seconds browsers may cache a preflight
+}
+
+func CORSConfigFromEnv() (CORSConfig, error) {
+	c := CORSConfig{
+		Origins: utils.EnvList("CORS_ORIGINS", []string{}),
+		AllowedHeaders: utils.EnvList("CORS_ALLOWED_HEADERS",
+			[]string{"Accept", "Authorization", "Content-Type", csrfHeader}),
+		ExposedHeaders: utils.EnvList("CORS_EXPOSED_HEADERS",
+			[]string{"Content-Location", "Location"}),
+		MaxAge: utils.EnvInt("CORS_MAX_AGE_SECONDS", 600),
+	}
+	for _, origin := range c.Origins {
+		if err := validateOrigin(origin); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// Origins must be scheme://host[:port]. The only wildcard allowed is a
+// leading "*." on the host, since any other placement could match
+// unrelated domains. A bare "*" is refused as credentials are allowed.
+func validateOrigin(origin string) error {
+	host := origin
+	if scheme, rest, ok := strings.Cut(origin, "://"); ok {
+		host = rest
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("CORS origin %q: scheme must be http or https", origin)
+		}
+	} else {
+		return fmt.Errorf("CORS origin %q: missing scheme", origin)
+	}
+	host = strings.TrimPrefix(host, "*.")
+	if strings.Contains(host, "*") {
+		return fmt.Errorf("CORS origin %q: only a leading *. wildcard is allowed", origin)
+	}
+	u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+	if err != nil || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("CORS origin %q: must be scheme://host[:port]", origin)
+	}
+	return nil
+}
+
+// Any origin, no cookies or credentials
+func (c CORSConfig) Public() func(http.Handler) http.Handler {
+	return cors.Handler(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "HEAD", "OPTIONS"},
+		AllowedHeaders: []string{"Accept"},
+		MaxAge:         c.MaxAge,
+	})
+}
+
+// Configured origins only, with credentials
+func (c CORSConfig) Credentialed() func(http.Handler) http.Handler {
+	opts := cors.Options{
+		AllowedOrigins:   c.Origins,
+		AllowedMethods:   METHODS,
+		AllowedHeaders:   c.AllowedHeaders,
+		ExposedHeaders:   c.ExposedHeaders,
+		AllowCredentials: true,
+		MaxAge:           c.MaxAge,
+	}
+	// the cors package treats an empty list as every origin
+	if len(c.Origins) == 0 {
+		opts.AllowOriginFunc = func(r *http.Request, origin string) bool { return false }
+	}
+	return cors.Handler(opts)
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+//==============================//
+// ---- API Key Management ---- //
+//==============================//
+
+var ErrApiKeyNameTaken = errors.New("api key name taken")
+
+// An API key without its secret
+type ApiKey struct {
+	Id         int        `db:"id" json:"id"`
+	UserId     int        `db:"user_id" json:"user_id"`
+	Name       string     `db:"name" json:"name"`
+	Prefix     string     `db:"prefix" json:"prefix"`
+	Scope      string     `db:"scope" json:"scope"`
+	AllowedIPs []string   `db:"allowed_ips" json:"allowed_ips"`
+	Expires    *time.Time `db:"expires" json:"expires"`
+	Created    time.Time  `db:"created" json:"created"`
+	LastUsed   *time.Time `db:"last_used" json:"last_used"`
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, scope, allowed_ips, expires, created, last_used"
+
+// Store a new key by the hash of its secret. Id and Created are filled in.
+func (db *Db) InsertApiKey(ctx context.Context, key *ApiKey, keyHash string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "INSERT INTO api_keys (user_id, name, prefix, key_hash, scope, allowed_ips, expires) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created;"
+	err := db.QueryRow(ctx, query,
+		key.UserId, key.Name, key.Prefix, keyHash, key.Scope, key.AllowedIPs, key.Expires,
+	).Scan(&key.Id, &key.Created)
+	var pgErr *pgconn.PgError
+	// 23505 unique_violation
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "api_keys_user_id_name_key" {
+		return ErrApiKeyNameTaken
+	}
+	return err
+}
+
+func (db *Db) SelectApiKeys(ctx context.Context, userId int) ([]ApiKey, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := orderedQueryConstructor("api_keys", apiKeyColumns, "user_id = $1", "id", 0)
+	rows, err := db.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ApiKey])
+}
+
+// Key and owner details needed to authenticate with a key
+type ApiKeyAuth struct {
+	ApiKey
+	KeyHash  string
+	Username string
+	IsActive bool
+	IsStaff  bool
+}
+
+func (db *Db) SelectApiKeyAuth(ctx context.Context, prefix string) (*ApiKeyAuth, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT k.id, k.user_id, k.name, k.prefix, k.scope, k.allowed_ips, k.expires, " +
+		"k.created, k.last_used, k.key_hash, u.username, u.is_active, u.is_staff " +
+		"FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.prefix = $1;"
+	var k ApiKeyAuth
+	err := db.QueryRow(ctx, query, prefix).Scan(
+		&k.Id, &k.UserId, &k.Name, &k.Prefix, &k.Scope, &k.AllowedIPs, &k.Expires,
+		&k.Created, &k.LastUsed, &k.KeyHash, &k.Username, &k.IsActive, &k.IsStaff,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &k, nil
+}
+
+// Record a use of the key. Written at most once a minute per key.
+func (db *Db) TouchApiKey(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := updateConstructor("api_keys", "last_used = CURRENT_TIMESTAMP",
+		"id = $1 AND (last_used IS NULL OR last_used < CURRENT_TIMESTAMP - INTERVAL '1 minute')")
+	_, err := db.Exec(ctx, query, id)
+	return err
+}
+
+// Revoke one of a user's keys. ErrNotFound if the user has no such key.
+func (db *Db) DeleteApiKey(ctx context.Context, userId int, id int) (*ApiKey, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "DELETE FROM api_keys WHERE user_id = $1 AND id = $2 RETURNING " + apiKeyColumns + ";"
+	rows, err := db.Query(ctx, query, userId, id)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ApiKey])
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &key, nil
+}
+
+// Revoke every key a user has, when their credentials may be compromised
+func (db *Db) DeleteUserApiKeys(ctx context.Context, userId int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := deleteConstructor("api_keys", "user_id = $1")
+	_, err := db.Exec(ctx, query, userId)
+	return err
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//==================================//
+// ---- Audit Event Management ---- //
+//==================================//
+
+type AuditEvent struct {
+	Id      int             `db:"id" json:"id"`
+	UserId  *int            `db:"user_id" json:"user_id"`
+	ActorId *int            `db:"actor_id" json:"actor_id"`
+	Event   string          `db:"event" json:"event"`
+	Detail  json.RawMessage `db:"detail" json:"detail"`
+	Created time.Time       `db:"created" json:"created"`
+}
+
+// Record an event against a user. actorId is the user that caused the
+// event, 0 if it was the system or an unauthenticated request.
+func (db *Db) InsertAuditEvent(ctx context.Context, userId int, actorId int, event string, detail map[string]any) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "INSERT INTO audit_events (user_id, actor_id, event, detail) " +
+		"VALUES ($1, $2, $3, $4);"
+	_, err := db.Exec(ctx, query,
+		nullableId(userId), nullableId(actorId), event, detail,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Audit events about a user, oldest first
+func (db *Db) SelectAuditEvents(ctx context.Context, userId int) ([]AuditEvent, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT id, user_id, actor_id, event, detail, created " +
+		"FROM audit_events WHERE user_id = $1 ORDER BY created, id;"
+	rows, err := db.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuditEvent])
+}
+
+func (db *Db) CountAuditEvents(ctx context.Context, userId int) (int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	var count int
+	query := queryConstructor("audit_events", "COUNT(*)", "user_id = $1")
+	err := db.QueryRow(ctx, query, userId).Scan(&count)
+	return count, err
+}
+
+// user ids start well above 0, so 0 is used for "no user"
+func nullableId(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
@@ -2,17 +2,19 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq"
-
-	"authapi/utils"
 )
 
 const (
@@ -20,28 +22,82 @@ const (
 	dbname = "authdb"
 )
 
-var port string = os.Getenv("PG_PORT")
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrUsernameTaken = errors.New("username taken")
+	ErrEmailTaken    = errors.New("email taken")
+
+	// Returned by RotateSession
+	ErrSessionReused  = errors.New("refresh token reused")
+	ErrSessionInvalid = errors.New("refresh token invalid")
+)
+
+// Translate pgx.ErrNoRows to ErrNotFound so callers don't depend on pgx
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
 
 type Db struct {
 	*pgxpool.Pool
 }
 
+// Deadline for each store method, 0 for none. Set from DB_QUERY_TIMEOUT_MS at startup.
+var QueryTimeout time.Duration
+
+// Bound a store method by QueryTimeout. Cancelling the request, such as
+// the client disconnecting, still cancels the query first.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, QueryTimeout)
+}
+
+// Run fn in a transaction bounded by QueryTimeout. fn gets the bounded
+// context and must use it for its statements.
+// Commits if fn returns nil, otherwise rolls back and returns fn's error.
+func (db *Db) inTx(ctx context.Context, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return fn(ctx, tx)
+	})
+}
+
+var (
+	service     *Db
+	serviceOnce sync.Once
+)
+
+// Shared connection pool, created on first use
 func DbService() *Db {
-	var PGUSER string = os.Getenv("POSTGRES_USER")
-	var PGPASSWD string = os.Getenv("POSTGRES_PASSWORD")
+	serviceOnce.Do(func() {
+		var PGUSER string = os.Getenv("POSTGRES_USER")
+		var PGPASSWD string = os.Getenv("POSTGRES_PASSWORD")
 
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", PGUSER, PGPASSWD, host, port, dbname)
+		connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", PGUSER, PGPASSWD, host, os.Getenv("PG_PORT"), dbname)
 
-	dbpool, err := pgxpool.New(context.Background(), connString)
-	if err != nil {
-		log.Fatal(err)
-	}
+		config, err := pgxpool.ParseConfig(connString)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.ConnConfig.Tracer = queryTracer{}
 
-	err = dbpool.Ping(context.Background())
-	if err != nil {
-		log.Fatal(err)
-	}
-	return &Db{dbpool}
+		dbpool, err := pgxpool.NewWithConfig(context.Background(), config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = dbpool.Ping(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		service = &Db{dbpool}
+	})
+	return service
 }
 
 type Country struct {
@@ -50,27 +106,35 @@ type Country struct {
 	Phone string `db:"dialcode"`
 }
 
-func (db *Db) GetCountry(code string) (*Country, error) {
+func (db *Db) GetCountry(ctx context.Context, code string) (*Country, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := "SELECT code, country, dialcode " +
 		"FROM countries WHERE code = $1;"
-	rows, err := db.Query(context.Background(), query, code)
+	rows, err := db.Query(ctx, query, code)
 	if err != nil {
-		fmt.Println("DB Error Occurred:", err)
 		return nil, err
 	}
 	c, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Country])
 	if err != nil {
-		fmt.Println("DB Error Occurred:", err)
-		return nil, err
+		return nil, notFound(err)
 	}
 	return &c, nil
 }
 
-func (db *Db) GetAllCountries() (*[]Country, error) {
+func (db *Db) GetAllCountries(ctx context.Context) (*[]Country, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := "SELECT code, country, dialcode FROM countries;"
-	rows, _ := db.Query(context.Background(), query)
+	rows, err := db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
 	c, err := pgx.CollectRows(rows, pgx.RowToStructByName[Country])
-	return &c, err
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
 }
 
 type NewUser struct {
@@ -78,22 +142,33 @@ type NewUser struct {
 	Email, Phone, Country string
 }
 
-func (db *Db) InsertUser(u NewUser) error {
-	query := "INSERT INTO users " +
+// Inserts the user, logged in as of now, and records the initial password
+// in password_history. One statement, so a failure leaves neither behind.
+// Returns the new user's id.
+func (db *Db) InsertUser(ctx context.Context, u NewUser) (int, error) {
+	query := "WITH u AS (INSERT INTO users " +
 		"(username, passwordHash, first_name, last_name, email, " +
-		"phone, country) VALUES " +
-		"($1, $2, $3, $4, $5, $6, $7);"
-	pwHash := utils.GetPasswordHash(u.Password)
+		"phone, country, last_login) VALUES " +
+		"($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP) RETURNING id, passwordHash, password_changed) " +
+		"INSERT INTO password_history (user_id, passwordHash, created) " +
+		"SELECT id, passwordHash, password_changed FROM u RETURNING user_id;"
+	pwHash, err := hashPassword(ctx, u.Password)
+	if err != nil {
+		return 0, err
+	}
+	// the deadline covers the query only, hashing is deliberately slow
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 
-	_, err := db.Exec(context.Background(), query,
+	var id int
+	err = db.QueryRow(ctx, query,
 		u.Username, pwHash, u.FirstName, u.LastName, u.Email,
 		u.Phone, u.Country,
-	)
+	).Scan(&id)
 	if err != nil {
-		fmt.Println("DB INSERT Error:", err)
-		return err
+		return 0, uniqueViolation(err)
 	}
-	return nil
+	return id, nil
 }
 
 //=====================================//
@@ -104,6 +179,15 @@ func queryConstructor(table string, cols string, selector string) string {
 	return fmt.Sprintf("SELECT %s FROM %s WHERE %s;", cols, table, selector)
 }
 
+// SELECT ordered by order, limited to the $limitArg parameter when limitArg > 0
+func orderedQueryConstructor(table string, cols string, selector string, order string, limitArg int) string {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s", cols, table, selector, order)
+	if limitArg > 0 {
+		query += fmt.Sprintf(" LIMIT $%d", limitArg)
+	}
+	return query + ";"
+}
+
 func updateConstructor(table string, val string, selector string) string {
 	return fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, val, selector)
 }
@@ -118,35 +202,42 @@ var userPrivate string = "id, username, first_name, last_name, email, " +
 
 var userPublic string = "id, username, country, is_active, date_joined"
 
+var userAuth string = "id, username, passwordHash, is_superuser, is_staff, is_active, " +
+	"password_changed, self_deactivated, deletion_scheduled, anonymized_at"
+
 //=================================//
 // ---- User Table Management ---- //
 //=================================//
 
 type User struct {
-	Id         int       `db:"id"`
-	Username   string    `db:"username"`
-	FirstName  string    `db:"first_name"`
-	LastName   string    `db:"last_name"`
-	Email      string    `db:"email"`
-	Phone      string    `db:"phone"`
-	Country    string    `db:"country"`
-	IsSuper    bool      `db:"is_superuser"`
-	IsStaff    bool      `db:"is_staff"`
-	Is_active  bool      `db:"is_active"`
-	DateJoined time.Time `db:"date_joined"`
-	LastLogin  time.Time `db:"last_login"`
+	Id         int        `db:"id"`
+	Username   string     `db:"username"`
+	FirstName  *string    `db:"first_name"`
+	LastName   *string    `db:"last_name"`
+	Email      string     `db:"email"`
+	Phone      *string    `db:"phone"`
+	Country    string     `db:"country"`
+	IsSuper    bool       `db:"is_superuser"`
+	IsStaff    bool       `db:"is_staff"`
+	Is_active  bool       `db:"is_active"`
+	DateJoined time.Time  `db:"date_joined"`
+	LastLogin  *time.Time `db:"last_login"`
 }
 
 // Get user private info. Protect for each user
-func (db *Db) SelectPrivateUserById(id int) (*User, error) {
+func (db *Db) SelectPrivateUserById(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := queryConstructor("users", userPrivate, "id = $1")
 
-	rows, _ := db.Query(context.Background(), query, id)
-	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[User])
+	rows, err := db.Query(ctx, query, id)
 	if err != nil {
-		fmt.Println("DB SELECT Error:", err)
 		return nil, err
 	}
+	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[User])
+	if err != nil {
+		return nil, notFound(err)
+	}
 	return &u, nil
 }
 
@@ -159,152 +250,537 @@ type UserPublic struct {
 }
 
 // Public Info about a user
-func (db *Db) SelectPublicUser(id int) (*UserPublic, error) {
+func (db *Db) SelectPublicUser(ctx context.Context, id int) (*UserPublic, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := queryConstructor("users", userPublic, "id = $1")
-	rows, _ := db.Query(context.Background(), query, id)
+	rows, err := db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
 	u, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[UserPublic])
-	if err == nil {
-		fmt.Println("DB SEL Err", err)
-		return &UserPublic{}, err
+	if err != nil {
+		return nil, notFound(err)
 	}
 	return &u, nil
 }
 
 type UserAuth struct {
-	Id           int    `db:"id"`
-	Username     string `db:"username"`
-	PasswordHash string `db:"passwordHash"`
-	IsSuperuser  bool   `db:"is_superuser"`
-	IsStaff      bool   `db:"is_staff"`
-	IsActive     bool   `db:"is_active"`
+	Id                int        `db:"id"`
+	Username          string     `db:"username"`
+	PasswordHash      string     `db:"passwordHash"`
+	IsSuperuser       bool       `db:"is_superuser"`
+	IsStaff           bool       `db:"is_staff"`
+	IsActive          bool       `db:"is_active"`
+	PasswordChanged   time.Time  `db:"password_changed"`
+	SelfDeactivated   bool       `db:"self_deactivated"`
+	DeletionScheduled *time.Time `db:"deletion_scheduled"`
+	AnonymizedAt      *time.Time `db:"anonymized_at"`
 }
 
 // Get user information prevelant to authentication and permissions
-func (db *Db) SelectUserAuth(username string) (*UserAuth, error) {
-	fields := "id, username, passwordHash, is_superuser, is_staff, is_active"
-	query := queryConstructor("users", fields, "username = $1")
-	rows, _ := db.Query(context.Background(), query, username)
-	s, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[UserAuth])
+func (db *Db) SelectUserAuth(ctx context.Context, username string) (*UserAuth, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := queryConstructor("users", userAuth, "username = $1")
+	rows, err := db.Query(ctx, query, username)
 	if err != nil {
 		return nil, err
 	}
-	println(s.PasswordHash)
+	s, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[UserAuth])
+	if err != nil {
+		return nil, notFound(err)
+	}
 	return &s, nil
 }
 
-type userId struct {
-	Id int
+func (db *Db) SelectUserAuthById(ctx context.Context, id int) (*UserAuth, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := queryConstructor("users", userAuth, "id = $1")
+	rows, err := db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	s, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[UserAuth])
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &s, nil
 }
 
-func (db *Db) GetUserId(username string) int {
+func (db *Db) GetUserId(ctx context.Context, username string) (int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := queryConstructor("users", "id", "username = $1")
-	rows, _ := db.Query(context.Background(), query, username)
-	id, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[userId])
-	if err != nil {
-		fmt.Println(err)
-		return 0
-	}
-	return id.Id
+	var id int
+	err := db.QueryRow(ctx, query, username).Scan(&id)
+	return id, notFound(err)
 }
 
-func (db *Db) GetUserIdWithEmail(email string) int {
-	query := queryConstructor("users", "id", "email = $1")
-	rows, _ := db.Query(context.Background(), query, email)
-	id, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[userId])
+func (db *Db) SelectUserHash(ctx context.Context, id int) (string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := queryConstructor("users", "passwordHash", "id = $1")
+	var hash string
+	err := db.QueryRow(ctx, query, id).Scan(&hash)
+	return hash, notFound(err)
+}
+
+// Permission names granted to a user
+func (db *Db) SelectUserPermissions(ctx context.Context, id int) ([]string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT p.name FROM permissions p " +
+		"JOIN permissions_users pu ON pu.permissions_id = p.id " +
+		"WHERE pu.user_id = $1 ORDER BY p.name;"
+	rows, err := db.Query(ctx, query, id)
 	if err != nil {
-		fmt.Println(err)
-		return 0
+		return nil, err
 	}
-	return id.Id
+	return pgx.CollectRows(rows, pgx.RowTo[string])
 }
 
-type userHash struct {
-	PasswordHash string `db:"passwordHash"`
+// A profile column in a partial update, following JSON Merge Patch (RFC 7396).
+// Absent leaves the column unchanged, null clears it.
+type PatchField struct {
+	Set   bool
+	Null  bool
+	Value string
 }
 
-func (db *Db) SelectUserHash(id int) string {
-	query := queryConstructor("users", "passwordHash", "id = $1")
-	rows, _ := db.Query(context.Background(), query, id)
-	h, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[userHash])
-	if err != nil {
-		fmt.Println(err)
-		return ""
+func (f *PatchField) UnmarshalJSON(b []byte) error {
+	f.Set = true
+	if string(b) == "null" {
+		f.Null = true
+		return nil
+	}
+	return json.Unmarshal(b, &f.Value)
+}
+
+type ProfileUpdate struct {
+	Username  PatchField
+	FirstName PatchField
+	LastName  PatchField
+	Email     PatchField
+	Phone     PatchField
+	Country   PatchField
+}
+
+// Columns a profile update can change.
+// Only names from this list are ever written to the query.
+var ProfileColumns = []string{"username", "first_name", "last_name", "email", "phone", "country"}
+
+// The field for a column name, nil if the column cannot be updated
+func (u *ProfileUpdate) Field(column string) *PatchField {
+	switch column {
+	case "username":
+		return &u.Username
+	case "first_name":
+		return &u.FirstName
+	case "last_name":
+		return &u.LastName
+	case "email":
+		return &u.Email
+	case "phone":
+		return &u.Phone
+	case "country":
+		return &u.Country
+	}
+	return nil
+}
+
+// Names of the columns being changed
+func (u *ProfileUpdate) Fields() []string {
+	var fields []string
+	for _, col := range ProfileColumns {
+		if u.Field(col).Set {
+			fields = append(fields, col)
+		}
 	}
-	return h.PasswordHash
+	return fields
 }
 
-// Updates user info with map. Validate map prior to calling func.
-func (db *Db) UpdateUserProfile(id int, updates map[string]any) error {
+// Apply a partial profile update. Validate the update prior to calling func.
+// Returns ErrUsernameTaken or ErrEmailTaken on a unique constraint violation.
+func (db *Db) UpdateUserProfile(ctx context.Context, id int, update ProfileUpdate) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	var updateSegment []string
-	var argNumber int = 2
 	var args []any
 	args = append(args, id)
 
-	for key, val := range updates {
-		setVal := fmt.Sprintf("%s = $%d", key, argNumber)
-		updateSegment = append(updateSegment, setVal)
+	for _, col := range ProfileColumns {
+		field := update.Field(col)
+		if !field.Set {
+			continue
+		}
+		var val any = field.Value
+		if field.Null {
+			val = nil
+		}
 		args = append(args, val)
-		argNumber += 1
+		updateSegment = append(updateSegment, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
+	if len(updateSegment) == 0 {
+		return nil
 	}
 	setSegment := strings.Join(updateSegment, ", ")
 	query := updateConstructor("users", setSegment, "id = $1")
-	_, err := db.Exec(context.Background(), query, args...)
+	_, err := db.Exec(ctx, query, args...)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+	return nil
+}
+
+// Translate unique constraint violations on users to ErrUsernameTaken or
+// ErrEmailTaken. Other errors are returned unchanged.
+func uniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	// 23505 unique_violation
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return err
+	}
+	switch pgErr.ConstraintName {
+	case "users_username_key":
+		return ErrUsernameTaken
+	case "users_email_key":
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// Set a new password. The hash is also recorded in password_history
+// and the password age is reset.
+func (db *Db) NewUserHashById(ctx context.Context, id int, password string) error {
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "WITH u AS (" +
+		updateConstructor("users", "passwordHash = $2, password_changed = $3", "id = $1") +
+		" RETURNING id, passwordHash, password_changed) " +
+		"INSERT INTO password_history (user_id, passwordHash, created) " +
+		"SELECT id, passwordHash, password_changed FROM u;"
+	_, err = db.Exec(ctx, query, id, hash, time.Now().UTC())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Db) NewUserHashById(id int, password string) error {
-	hash := utils.GetPasswordHash(password)
+// Replace the stored hash of the current password with one using the
+// current hashing parameters. Password history and age are untouched.
+func (db *Db) RehashUserPassword(ctx context.Context, id int, password string) error {
+	hash, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := updateConstructor("users", "passwordHash = $2", "id = $1")
-	_, err := db.Exec(context.Background(), query, id, hash)
+	_, err = db.Exec(ctx, query, id, hash)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Db) UpdateUserLoginTime(id int) error {
+// Times the user's password was set, oldest first
+func (db *Db) SelectPasswordChangeTimes(ctx context.Context, id int) ([]time.Time, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT created FROM password_history WHERE user_id = $1 ORDER BY created;"
+	rows, err := db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[time.Time])
+}
+
+// Most recent password hashes for a user, newest first
+func (db *Db) SelectPasswordHistory(ctx context.Context, id int, limit int) ([]string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT passwordHash FROM password_history " +
+		"WHERE user_id = $1 ORDER BY created DESC LIMIT $2;"
+	rows, err := db.Query(ctx, query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (db *Db) UpdateUserLoginTime(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := updateConstructor("users", "last_login = $2", "id = $1")
 	timeStamp := time.Now().UTC().Format(time.RFC3339)
-	_, err := db.Exec(context.Background(), query, id, timeStamp)
+	_, err := db.Exec(ctx, query, id, timeStamp)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	return nil
 }
 
-func (db *Db) DeleteUser(id int) error {
+func (db *Db) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := deleteConstructor("users", "id = $1")
-	_, err := db.Exec(context.Background(), query, id)
+	_, err := db.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+type UserFilter struct {
+	Query       string // partial match on username, private searches also match email and names
+	Country     string
+	Active      *bool
+	Staff       *bool // private searches only
+	JoinedAfter *time.Time
+	AfterId     int // keyset cursor, the last id of the previous page
+}
+
+// Build the WHERE clause and arguments for a user search.
+// Limit is always the last argument, for the caller's LIMIT.
+func (f *UserFilter) whereClause(private bool, limit int) (string, []any) {
+	var where []string
+	var args []any
+	addArg := func(cond string, val any) {
+		args = append(args, val)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	addArg("id > $%d", f.AfterId)
+	if !private {
+		// erased accounts only keep placeholders, staff may still need them
+		where = append(where, "anonymized_at IS NULL")
+	}
+	if f.Query != "" {
+		pattern := "%" + likeEscaper.Replace(f.Query) + "%"
+		if private {
+			addArg("(username ILIKE $%[1]d OR email ILIKE $%[1]d OR "+
+				"first_name ILIKE $%[1]d OR last_name ILIKE $%[1]d)", pattern)
+		} else {
+			addArg("username ILIKE $%d", pattern)
+		}
+	}
+	if f.Country != "" {
+		addArg("country = $%d", f.Country)
+	}
+	if f.Active != nil {
+		addArg("is_active = $%d", *f.Active)
+	}
+	if f.Staff != nil && private {
+		addArg("is_staff = $%d", *f.Staff)
+	}
+	if f.JoinedAfter != nil {
+		addArg("date_joined > $%d", *f.JoinedAfter)
+	}
+	args = append(args, limit)
+
+	return strings.Join(where, " AND "), args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Search users with private info, for staff. Results are ordered by id.
+func (db *Db) SearchUsers(ctx context.Context, f UserFilter, limit int) ([]User, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	where, args := f.whereClause(true, limit)
+	query := orderedQueryConstructor("users", userPrivate, where, "id", len(args))
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[User])
+}
+
+// Search users with public info only. Results are ordered by id.
+func (db *Db) SearchPublicUsers(ctx context.Context, f UserFilter, limit int) ([]UserPublic, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	where, args := f.whereClause(false, limit)
+	query := orderedQueryConstructor("users", userPublic, where, "id", len(args))
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[UserPublic])
+}
+
+// Set account status as staff. Overrides a deactivation or scheduled
+// deletion made by the user, so the user cannot undo it by logging in.
+// ErrNotFound if the user is gone or erased.
+func (db *Db) SetUserActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := updateConstructor("users",
+		"is_active = $2, self_deactivated = FALSE, deletion_scheduled = NULL",
+		"id = $1 AND anonymized_at IS NULL")
+	tag, err := db.Exec(ctx, query, id, active)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db *Db) SetUserPrivileges(ctx context.Context, id int, isStaff bool, isSuperuser bool) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := updateConstructor("users", "is_staff = $2, is_superuser = $3", "id = $1")
+	_, err := db.Exec(ctx, query, id, isStaff, isSuperuser)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Remove the user's password hash. Login returns "Password Change Needed"
+// until a new password is set through the reset token flow.
+func (db *Db) ClearUserHash(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := updateConstructor("users", "passwordHash = ''", "id = $1")
+	_, err := db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//=========================================//
+// ---- Deactivation and Data Erasure ---- //
+//=========================================//
+
+// Deactivate an account at the user's request and remove all sessions.
+// deleteAt schedules erasure, nil only deactivates.
+// The user reactivates the account, cancelling any erasure, by logging in.
+func (db *Db) DeactivateUser(ctx context.Context, id int, deleteAt *time.Time) error {
+	return db.inTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		query := updateConstructor("users",
+			"is_active = FALSE, self_deactivated = TRUE, deletion_scheduled = $2", "id = $1")
+		_, err := tx.Exec(ctx, query, id, deleteAt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, deleteConstructor("sessions", "user_id = $1"), id)
+		return err
+	})
+}
+
+// Reactivate an account and cancel scheduled erasure.
+// Returns ErrNotFound for anonymized accounts, which stay erased.
+func (db *Db) ReactivateUser(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := updateConstructor("users",
+		"is_active = TRUE, self_deactivated = FALSE, deletion_scheduled = NULL",
+		"id = $1 AND anonymized_at IS NULL")
+	tag, err := db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Ids of users whose grace period has ended and have not been erased yet
+func (db *Db) SelectUsersDueForErasure(ctx context.Context) ([]int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := queryConstructor("users", "id",
+		"deletion_scheduled <= CURRENT_TIMESTAMP AND anonymized_at IS NULL")
+	rows, err := db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+// Scrub personal data from a user. The row is kept with a placeholder
+// username and email so audit_events still reference a valid user.
+// Sessions, password history, permissions and API keys are removed.
+func (db *Db) AnonymizeUser(ctx context.Context, id int) error {
+	return db.inTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		scrub := "username = 'deleted-' || id, " +
+			"email = 'deleted-' || id || '@invalid', " +
+			"passwordHash = '', first_name = NULL, last_name = NULL, " +
+			"phone = NULL, country = 'XX', session_id = NULL, " +
+			"is_active = FALSE, is_staff = FALSE, is_superuser = FALSE, " +
+			"self_deactivated = FALSE, deletion_scheduled = NULL, anonymized_at = CURRENT_TIMESTAMP"
+		_, err := tx.Exec(ctx, updateConstructor("users", scrub, "id = $1"), id)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"sessions", "password_history", "permissions_users", "api_keys"} {
+			_, err = tx.Exec(ctx, deleteConstructor(table, "user_id = $1"), id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 //====================================//
 // ---- Session table management ---- //
 //====================================//
 
-func (db *Db) NewUserSession(id int, token string, pwReset bool) error {
-	query := "INSERT INTO sessions (token, user_id, pw_reset, expires) VALUES ($1, $2, $3, $4)"
+// Lifetimes of refresh and password reset tokens
+const (
+	RefreshTokenLifetime = time.Hour * 720 // 30 days
+	ResetTokenLifetime   = time.Minute * 5
+)
+
+// Audience and scope that access tokens from a session are issued for.
+// The zero value is a session for this API without restrictions.
+type SessionGrant struct {
+	Audience string
+	Scope    string
+}
+
+func (db *Db) NewUserSession(ctx context.Context, id int, token string, pwReset bool, grant SessionGrant) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "INSERT INTO sessions (token, user_id, pw_reset, expires, audience, scope) " +
+		"VALUES ($1, $2, $3, $4, $5, $6)"
 	var expire time.Time
 	if pwReset {
-		expire = time.Now().UTC().Add(time.Minute * 5)
+		expire = time.Now().UTC().Add(ResetTokenLifetime)
 	} else {
-		expire = time.Now().UTC().Add(time.Hour * 720) // 30 days
+		expire = time.Now().UTC().Add(RefreshTokenLifetime)
 	}
-	_, err := db.Exec(context.Background(), query, token, id, pwReset, expire)
+	_, err := db.Exec(ctx, query, token, id, pwReset, expire, grant.Audience, grant.Scope)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	return nil
 }
 
+// Store a password reset token for the account with the email, if there is
+// one that hasn't been erased. Lookup and insert are one statement, so an
+// unknown email costs the same round trip and reports nothing.
+func (db *Db) NewPasswordResetSession(ctx context.Context, email string, token string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "INSERT INTO sessions (token, user_id, pw_reset, expires, audience, scope) " +
+		"SELECT $1, id, TRUE, $2, '', '' FROM users WHERE email = $3 AND anonymized_at IS NULL;"
+	_, err := db.Exec(ctx, query, token, time.Now().UTC().Add(ResetTokenLifetime), email)
+	return err
+}
+
 type sessionCheck struct {
 	Valid   bool      `db:"valid"`
 	User_id int       `db:"user_id"`
@@ -319,15 +795,21 @@ type sessionCheck struct {
 //     - user is authorized, invalidate session and refresh jwt
 //  2. false, no error
 //     - session is assumed hijacked, delete all user tokens
-//  3. false, error( 'ErrNoRows' )
+//  3. false, ErrNotFound
 //     - token was removed, user is asked to login again
-func (db *Db) QueryToken(token string, id int, pwReset bool) (bool, error) {
+//
+// Refreshes use RotateSession, which checks and replaces the token atomically.
+func (db *Db) QueryToken(ctx context.Context, token string, id int, pwReset bool) (bool, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := queryConstructor("sessions", "valid, user_id, pw_reset, expires", "token = $1")
-	rows, _ := db.Query(context.Background(), query, token)
+	rows, err := db.Query(ctx, query, token)
+	if err != nil {
+		return false, err
+	}
 	s, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[sessionCheck])
 	if err != nil || s.User_id != id {
-		fmt.Println(err)
-		return false, err
+		return false, notFound(err)
 	}
 
 	if time.Now().UTC().After(s.Expires) {
@@ -347,34 +829,121 @@ func (db *Db) QueryToken(token string, id int, pwReset bool) (bool, error) {
 	return true, nil
 }
 
-// invalidate the old refresh token after it has been used
-func (db *Db) InvalidateSession(token string) error {
-	query := updateConstructor("sessions", "valid = FALSE", "token = $1")
-	_, err := db.Exec(context.Background(), query, token)
-	if err != nil {
-		fmt.Println(err)
+// Swap a refresh token for newToken, which keeps the session's grant.
+// The old token's row is locked, so of two refreshes racing with the same
+// token exactly one succeeds and the other sees it as reused.
+//   - ErrNotFound: the token does not exist, e.g. the user logged out
+//   - ErrSessionInvalid: expired, a reset token, or not owned by userId
+//   - ErrSessionReused: already rotated. Every session of the owner is
+//     deleted, as the token is assumed stolen.
+func (db *Db) RotateSession(ctx context.Context, token string, userId int, newToken string) (SessionGrant, error) {
+	var reused bool
+	var grant SessionGrant
+	err := db.inTx(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		query := queryConstructor("sessions", "valid, user_id, pw_reset, expires, audience, scope", "token = $1 FOR UPDATE")
+		var s sessionCheck
+		err := tx.QueryRow(ctx, query, token).Scan(&s.Valid, &s.User_id, &s.PwReset, &s.Expires, &grant.Audience, &grant.Scope)
+		if err != nil {
+			return notFound(err)
+		}
+		if s.PwReset || s.User_id != userId || time.Now().UTC().After(s.Expires) {
+			return ErrSessionInvalid
+		}
+		if !s.Valid {
+			reused = true
+			_, err = tx.Exec(ctx, deleteConstructor("sessions", "user_id = $1"), s.User_id)
+			return err
+		}
+
+		_, err = tx.Exec(ctx, updateConstructor("sessions", "valid = FALSE", "token = $1"), token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO sessions (token, user_id, pw_reset, expires, audience, scope) "+
+			"VALUES ($1, $2, FALSE, $3, $4, $5)",
+			newToken, userId, time.Now().UTC().Add(RefreshTokenLifetime), grant.Audience, grant.Scope)
 		return err
+	})
+	if err == nil && reused {
+		// the deletion is committed before reporting the reuse
+		return SessionGrant{}, ErrSessionReused
 	}
-	return nil
+	return grant, err
+}
+
+// Owner of a session token, for refreshes that come with a cookie and no access token.
+// The token still has to be checked with QueryToken.
+func (db *Db) SelectSessionUserId(ctx context.Context, token string) (int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := queryConstructor("sessions", "user_id", "token = $1")
+	var id int
+	err := db.QueryRow(ctx, query, token).Scan(&id)
+	return id, notFound(err)
+}
+
+// Refresh tokens that are still usable, for the active sessions gauge
+func (db *Db) CountActiveSessions(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT count(*) FROM sessions " +
+		"WHERE valid AND NOT pw_reset AND expires > now() AT TIME ZONE 'UTC';"
+	var count int
+	err := db.QueryRow(ctx, query).Scan(&count)
+	return count, err
+}
+
+// Session details without the token itself
+type SessionInfo struct {
+	Expires time.Time `db:"expires" json:"expires"`
+	Valid   bool      `db:"valid" json:"valid"`
+	PwReset bool      `db:"pw_reset" json:"pw_reset"`
+}
+
+func (db *Db) SelectUserSessions(ctx context.Context, id int) ([]SessionInfo, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := "SELECT expires, valid, pw_reset FROM sessions " +
+		"WHERE user_id = $1 ORDER BY expires;"
+	rows, err := db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[SessionInfo])
 }
 
 // Invalidate all user sessions based on id.
 // Used to force a user to login.
-// This should be triggered after an invalidated token has been reused.
-func (db *Db) InvalidateAllSessions(id int) error {
+func (db *Db) InvalidateAllSessions(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := deleteConstructor("sessions", "user_id = $1")
-	_, err := db.Exec(context.Background(), query, id)
+	_, err := db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete every session for a user except the one given.
+// Used to sign out other clients after a password change.
+func (db *Db) InvalidateOtherSessions(ctx context.Context, id int, keepToken string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	query := deleteConstructor("sessions", "user_id = $1 AND token <> $2")
+	_, err := db.Exec(ctx, query, id, keepToken)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	return nil
 }
 
 // delete single session. Used for logging out
-func (db *Db) DeleteSession(token string) error {
+func (db *Db) DeleteSession(ctx context.Context, token string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := deleteConstructor("sessions", "token = $1")
-	_, err := db.Exec(context.Background(), query, token)
+	_, err := db.Exec(ctx, query, token)
 	if err != nil {
 		return err
 	}
@@ -382,12 +951,28 @@ func (db *Db) DeleteSession(token string) error {
 }
 
 // Only for testing purposes. Need to disable for production use, dynamically or manually
-func (db *Db) DeleteAllUsers() error {
+func (db *Db) DeleteAllUsers(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 	query := "DELETE FROM users;"
-	_, err := db.Exec(context.Background(), query)
+	_, err := db.Exec(ctx, query)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	return nil
 }
+
+//==========================//
+// ---- Schema Version ---- //
+//==========================//
+
+// Version of init.sql this server was written against
+const SchemaVersion = 3
+
+func (db *Db) SelectSchemaVersion(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	var version int
+	err := db.QueryRow(ctx, "SELECT max(version) FROM schema_version;").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"authapi/utils"
+)
+
+var tracer = otel.Tracer("authapi/db")
+
+// pgx tracer hooks. Every query gets a span named after the Db method that
+// ran it, and is logged at debug level with the caller's context so lines
+// carry the request id. Arguments are never recorded, they hold hashes and tokens.
+type queryTracer struct{}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	sql   string
+	start time.Time
+}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = tracer.Start(ctx, "db."+callerMethod(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(data.SQL),
+		))
+	return context.WithValue(ctx, queryStartKey{}, queryStart{data.SQL, time.Now()})
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+
+	q, _ := ctx.Value(queryStartKey{}).(queryStart)
+	attrs := []slog.Attr{
+		slog.String("sql", q.sql),
+		slog.Duration("duration", time.Since(q.start)),
+	}
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, "query failed")
+		slog.LogAttrs(ctx, slog.LevelWarn, "query failed", append(attrs, slog.Any("error", data.Err))...)
+		return
+	}
+	span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	slog.LogAttrs(ctx, slog.LevelDebug, "query", attrs...)
+}
+
+// Name of the *Db method that issued the query, e.g. "SelectUserAuth"
+func callerMethod() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if _, method, ok := strings.Cut(frame.Function, "authapi/db.(*Db)."); ok {
+			method, _, _ = strings.Cut(method, ".")
+			return method
+		}
+		if !more {
+			return "query"
+		}
+	}
+}
+
+// Hash a password in a span, hashing is the slowest step of most writes
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "utils.GetPasswordHash",
+		trace.WithAttributes(attribute.String("hash.algorithm", utils.PasswordHashing.Algorithm)))
+	defer span.End()
+	hash, err := utils.GetPasswordHash(password)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "hashing failed")
+	}
+	return hash, err
+}
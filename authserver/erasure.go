@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"authapi/db"
+)
+
+// Account events from deactivation and erasure
+const (
+	EventAccountDeactivated = "account_deactivated"
+	EventDeletionScheduled  = "deletion_scheduled"
+	EventAccountReactivated = "account_reactivated"
+	EventDeletionCancelled  = "deletion_cancelled"
+	EventAccountAnonymized  = "account_anonymized"
+)
+
+// Periodically erase personal data of users whose deletion grace period
+// has ended. Runs for the life of the process.
+func erasureWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		eraseDueUsers(context.Background())
+		<-ticker.C
+	}
+}
+
+func eraseDueUsers(ctx context.Context) {
+	ids, err := db.DbService().SelectUsersDueForErasure(ctx)
+	if err != nil {
+		slog.Error("erasure query failed", "error", err)
+		return
+	}
+	for _, id := range ids {
+		err = eraseUser(ctx, id, 0)
+		if err != nil {
+			slog.Error("erasure failed", "user_id", id, "error", err)
+		}
+	}
+}
+
+// Anonymize a user and record it. actorId is 0 when erased by the worker.
+func eraseUser(ctx context.Context, id int, actorId int) error {
+	err := db.DbService().AnonymizeUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	emitEvent(ctx, Event{Name: EventAccountAnonymized, UserId: id, ActorId: actorId})
+	return nil
+}
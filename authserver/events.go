@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"authapi/db"
+)
+
+// Account events recorded to the audit log
+const (
+	EventPasswordChanged = "password_changed"
+)
+
+type Event struct {
+	Name    string
+	UserId  int
+	ActorId int
+	Detail  map[string]any
+}
+
+// Notifiers are called for every event after it is written to the audit log.
+// There is no email service yet, so the default notifier only logs.
+var notifiers = []func(Event){
+	func(e Event) {
+		slog.Info("notify user", "user_id", e.UserId, "event", e.Name)
+	},
+}
+
+// Record an event in the audit log and pass it to the notifiers.
+// Failures are logged and otherwise ignored so they never fail the request.
+// The action has already happened, so the write is not cancelled with the request.
+func emitEvent(ctx context.Context, e Event) {
+	ctx = context.WithoutCancel(ctx)
+	err := db.DbService().InsertAuditEvent(ctx, e.UserId, e.ActorId, e.Name, e.Detail)
+	if err != nil {
+		slog.ErrorContext(ctx, "audit event failed", "event", e.Name, "user_id", e.UserId, "error", err)
+	}
+	for _, notify := range notifiers {
+		notify(e)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+const EventDataExported = "data_exported"
+
+// Everything held about a user, for data subject access requests
+type userExport struct {
+	Generated       time.Time        `json:"generated"`
+	Profile         *db.User         `json:"profile"`
+	Permissions     []string         `json:"permissions"`
+	Sessions        []db.SessionInfo `json:"sessions"`
+	ApiKeys         []db.ApiKey      `json:"api_keys"`
+	PasswordChanges []time.Time      `json:"password_changes"`
+	Mfa             mfaStatus        `json:"mfa"`
+	AuditEvents     []db.AuditEvent  `json:"audit_events"`
+}
+
+// MFA is not implemented yet, so no user is ever enrolled
+type mfaStatus struct {
+	Enrolled bool     `json:"enrolled"`
+	Methods  []string `json:"methods"`
+}
+
+func buildUserExport(ctx context.Context, id int) (*userExport, error) {
+	var err error
+	export := userExport{
+		Generated: time.Now().UTC(),
+		Mfa:       mfaStatus{Enrolled: false, Methods: []string{}},
+	}
+	if export.Profile, err = db.DbService().SelectPrivateUserById(ctx, id); err != nil {
+		return nil, err
+	}
+	if export.Permissions, err = db.DbService().SelectUserPermissions(ctx, id); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = db.DbService().SelectUserSessions(ctx, id); err != nil {
+		return nil, err
+	}
+	if export.ApiKeys, err = db.DbService().SelectApiKeys(ctx, id); err != nil {
+		return nil, err
+	}
+	if export.PasswordChanges, err = db.DbService().SelectPasswordChangeTimes(ctx, id); err != nil {
+		return nil, err
+	}
+	if export.AuditEvents, err = db.DbService().SelectAuditEvents(ctx, id); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// Encode an export as JSON, or as a zip archive holding the JSON file
+func encodeUserExport(export *userExport, zipped bool) ([]byte, error) {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil || !zipped {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create(fmt.Sprintf("user-%d.json", export.Profile.Id))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(data); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//=============================//
+// ---- Async Export Jobs ---- //
+//=============================//
+
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+type exportJob struct {
+	Id      string    `json:"id"`
+	UserId  int       `json:"user_id"`
+	Status  string    `json:"status"`
+	Zipped  bool      `json:"zipped"`
+	Created time.Time `json:"created"`
+	data    []byte
+}
+
+var exportJobs = struct {
+	sync.Mutex
+	jobs map[string]*exportJob
+}{jobs: map[string]*exportJob{}}
+
+// Returned by startExportJob with the job still being built
+var errExportInProgress = errors.New("export in progress")
+
+// The job outlives the request, ctx only carries its trace and log attributes.
+// A user has one job in flight at most, and a new job replaces their
+// finished ones, so memory held per user stays bounded.
+func startExportJob(ctx context.Context, userId int, actorId int, zipped bool) (*exportJob, error) {
+	ctx = context.WithoutCancel(ctx)
+	jobId, err := utils.GenerateCryptoString()
+	if err != nil {
+		return nil, err
+	}
+	job := &exportJob{
+		Id:      jobId,
+		UserId:  userId,
+		Status:  exportPending,
+		Zipped:  zipped,
+		Created: time.Now().UTC(),
+	}
+
+	exportJobs.Lock()
+	for _, j := range exportJobs.jobs {
+		if j.UserId == userId && j.Status == exportPending {
+			jobCopy := *j
+			exportJobs.Unlock()
+			return &jobCopy, errExportInProgress
+		}
+	}
+	for id, j := range exportJobs.jobs {
+		if j.UserId == userId || time.Since(j.Created) > ExportRetention {
+			delete(exportJobs.jobs, id)
+		}
+	}
+	exportJobs.jobs[jobId] = job
+	jobCopy := *job
+	exportJobs.Unlock()
+
+	go func() {
+		status := exportReady
+		export, err := buildUserExport(ctx, userId)
+		var data []byte
+		if err == nil {
+			data, err = encodeUserExport(export, zipped)
+		}
+		if err != nil {
+			slog.Error("export failed", "user_id", userId, "job_id", job.Id, "error", err)
+			status = exportFailed
+		} else {
+			emitExported(ctx, userId, actorId, true, zipped)
+		}
+		exportJobs.Lock()
+		job.Status, job.data = status, data
+		exportJobs.Unlock()
+	}()
+	return &jobCopy, nil
+}
+
+// Record an export once it has been built
+func emitExported(ctx context.Context, userId int, actorId int, async bool, zipped bool) {
+	emitEvent(ctx, Event{
+		Name:    EventDataExported,
+		UserId:  userId,
+		ActorId: actorId,
+		Detail:  map[string]any{"async": async, "zipped": zipped},
+	})
+}
+
+// Copy of the job for the given user, nil if it does not exist or has expired
+func getExportJob(userId int, jobId string) *exportJob {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	job, ok := exportJobs.jobs[jobId]
+	if !ok || job.UserId != userId || time.Since(job.Created) > ExportRetention {
+		return nil
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
+//===========================//
+// ---- Export Handlers ---- //
+//===========================//
+
+// Export all data held about a user. Self or staff only.
+// Query params: format=zip for a zip archive, async=true to always build in the background.
+// Small exports are returned directly; large ones return 202 with the job status location.
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	userId, ok := exportTarget(w, r)
+	if !ok {
+		return
+	}
+	zipped := r.URL.Query().Get("format") == "zip" || responseType(r) == MediaTypes["zip"]
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+
+	if !async {
+		count, err := db.DbService().CountAuditEvents(r.Context(), userId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		async = count > ExportSyncMaxEvents
+	}
+	user := PrincipalFrom(r.Context())
+
+	if async {
+		job, err := startExportJob(r.Context(), userId, user.UserId, zipped)
+		if errors.Is(err, errExportInProgress) {
+			w.Header().Add("Location", fmt.Sprintf("/user/%d/export/%s", userId, job.Id))
+			writeProblem(w, r, http.StatusConflict, CodeConflict, "An export is already in progress")
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Add("Location", fmt.Sprintf("/user/%d/export/%s", userId, job.Id))
+		utils.WriteJSON(w, job, http.StatusAccepted)
+		return
+	}
+
+	export, err := buildUserExport(r.Context(), userId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	data, err := encodeUserExport(export, zipped)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	emitExported(r.Context(), userId, user.UserId, false, zipped)
+	writeExportFile(w, userId, data, zipped)
+}
+
+// Status of a background export
+func getExportStatus(w http.ResponseWriter, r *http.Request) {
+	userId, ok := exportTarget(w, r)
+	if !ok {
+		return
+	}
+	job := getExportJob(userId, chi.URLParam(r, "job_id"))
+	if job == nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "Export Not Found")
+		return
+	}
+	if job.Status == exportReady {
+		w.Header().Add("Location", fmt.Sprintf("/user/%d/export/%s/download", userId, job.Id))
+	}
+	utils.WriteJSON(w, job, 200)
+}
+
+func downloadExport(w http.ResponseWriter, r *http.Request) {
+	userId, ok := exportTarget(w, r)
+	if !ok {
+		return
+	}
+	job := getExportJob(userId, chi.URLParam(r, "job_id"))
+	if job == nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "Export Not Found")
+		return
+	}
+	if job.Status != exportReady {
+		writeProblem(w, r, http.StatusConflict, CodeConflict, "Export Not Ready")
+		return
+	}
+	writeExportFile(w, userId, job.data, job.Zipped)
+}
+
+// extends export handlers
+// Parses the user id from the route and checks the caller is that user or staff.
+func exportTarget(w http.ResponseWriter, r *http.Request) (int, bool) {
+	user := PrincipalFrom(r.Context())
+	userRequested, err := strconv.Atoi(chi.URLParam(r, "user_id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "")
+		return 0, false
+	}
+	if !user.Is(userRequested) && !user.IsStaff {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "You cannot export another user's data")
+		return 0, false
+	}
+	if !user.Is(userRequested) && !superuserTargetAllowed(w, r, userRequested) {
+		return 0, false
+	}
+	return userRequested, true
+}
+
+func writeExportFile(w http.ResponseWriter, userId int, data []byte, zipped bool) {
+	contentType, ext := "application/json", "json"
+	if zipped {
+		contentType, ext = "application/zip", "zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"user-%d-export.%s\"", userId, ext))
+	w.WriteHeader(200)
+	w.Write(data)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Set when the server starts shutting down, so /readyz fails and load
+// balancers stop sending traffic before the listener closes
+var shuttingDown atomic.Bool
+
+// Liveness probe. Answers as long as the process is serving requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Readiness probe. Fails with 503 while shutting down, or when the database
+// is unreachable, the signing key cannot be loaded or the schema is older
+// than the server. Reasons are logged rather than returned.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	result := readiness{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			slog.WarnContext(ctx, "readiness check failed", "check", name, "error", err)
+			result.Status = "unavailable"
+			result.Checks[name] = "failing"
+			return
+		}
+		result.Checks[name] = "ok"
+	}
+
+	if shuttingDown.Load() {
+		result.Status = "unavailable"
+		result.Checks["shutdown"] = "draining"
+	}
+
+	dbService := db.DbService()
+	check("database", dbService.Ping(ctx))
+	check("signing_key", signingKeyWorks(ctx))
+	check("schema", schemaCurrent(ctx, dbService))
+
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	utils.WriteJSON(w, result, status)
+}
+
+func schemaCurrent(ctx context.Context, dbService *db.Db) error {
+	have, err := dbService.SelectSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if have < db.SchemaVersion {
+		return fmt.Errorf("database schema version %d, server needs %d", have, db.SchemaVersion)
+	}
+	return nil
+}
+
+// Signing is checked at most this often, so frequent probes don't each
+// make a call to a remote signer
+const signingProbeTTL = 30 * time.Second
+
+var signingProbe struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// Sign and verify a probe message, which also reaches a remote signer.
+// The result is reused for signingProbeTTL.
+func signingKeyWorks(ctx context.Context) error {
+	signingProbe.Lock()
+	defer signingProbe.Unlock()
+	if time.Since(signingProbe.checked) < signingProbeTTL {
+		return signingProbe.err
+	}
+	err := signProbe(ctx)
+	if ctx.Err() == nil {
+		signingProbe.checked, signingProbe.err = time.Now(), err
+	}
+	return err
+}
+
+func signProbe(ctx context.Context) error {
+	probe := []byte("readyz")
+	sig, err := utils.Keys.Sign(ctx, probe)
+	if err != nil {
+		return err
+	}
+	if !utils.Keys.Verify(probe, sig) {
+		return fmt.Errorf("signature from the signing key does not verify")
+	}
+	return nil
+}
+
+type buildInfo struct {
+	Version   string          `json:"version"`
+	Commit    string          `json:"commit,omitempty"`
+	BuildTime string          `json:"build_time,omitempty"`
+	Modified  bool            `json:"modified,omitempty"`
+	GoVersion string          `json:"go_version"`
+	Schema    int             `json:"schema_version"`
+	Features  map[string]bool `json:"features"`
+}
+
+// Build and configuration summary. Commit details come from the VCS stamp
+// go build embeds when built inside the git checkout.
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Schema:    db.SchemaVersion,
+		Features: map[string]bool{
+			"session_cookies":   SessionCookies.Enabled,
+			"breach_list":       PWPolicy.Breached != nil,
+			"metrics_auth":      os.Getenv("METRICS_TOKEN") != "",
+			"tracing":           tracingEnabled(),
+			"credentialed_cors": len(CORS.Origins) > 0,
+			"remote_signer":     os.Getenv("KEY_SOURCE") == "remote",
+		},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.time":
+				info.BuildTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	utils.WriteJSON(w, info, http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"authapi/utils"
+)
+
+// Filled in by inner middleware so the request line can report it
+type requestLog struct {
+	userId int
+}
+
+type requestLogKey struct{}
+
+// Log one line per request. Placed after chi's RequestID, whose id is added
+// to every record logged with the request context and sent back in X-Request-Id.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqId := middleware.GetReqID(r.Context())
+		w.Header().Set(middleware.RequestIDHeader, reqId)
+
+		info := &requestLog{}
+		ctx := context.WithValue(r.Context(), requestLogKey{}, info)
+		ctx = utils.WithLogAttrs(ctx, slog.String("request_id", reqId))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", chi.RouteContext(r.Context()).RoutePattern()),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if info.userId != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userId))
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		// ctx already carries the request id
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// Attach the authenticated user to the request's log lines.
+// Used by TokenRequired and validateUserCreds.
+func logUser(r *http.Request, userId int) *http.Request {
+	if info, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		info.userId = userId
+	}
+	ctx := utils.WithLogAttrs(r.Context(), slog.Int("user_id", userId))
+	return r.WithContext(ctx)
+}
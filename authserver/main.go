@@ -1,45 +1,152 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 	"github.com/joho/godotenv"
 
 	"authapi/db"
+	"authapi/utils"
 )
 
 func main() {
+	if err := run(); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// The server's lifetime. Returning instead of exiting lets the deferred
+// database and tracing shutdowns run.
+func run() error {
 	err := godotenv.Load("../.env")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	logLevel, err := utils.ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(utils.NewLogger(os.Stdout, logLevel, os.Getenv("LOG_FORMAT") != "text"))
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	PWPolicy, err = utils.PasswordPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	utils.PasswordHashing, err = utils.HashParamsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	keySource, err := utils.KeySourceFromEnv()
+	if err != nil {
+		return err
+	}
+	utils.Keys, err = utils.NewKeyStore(context.Background(), keySource, utils.EnvList("VERIFY_KEYS", nil))
+	if err != nil {
+		return err
+	}
+	if reload := utils.EnvInt("KEY_RELOAD_SECONDS", 30); reload > 0 {
+		go utils.Keys.Watch(context.Background(), time.Duration(reload)*time.Second)
 	}
 
+	CORS, err = CORSConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	SessionCookies, err = SessionCookieConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	TokenGrants, err = TokenGrantConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	DeletionGrace = utils.EnvDays("ACCOUNT_DELETION_GRACE_DAYS", 30)
+	ErasureInterval = time.Duration(utils.EnvInt("ERASURE_INTERVAL_MINUTES", 60)) * time.Minute
+	if ErasureInterval <= 0 {
+		return fmt.Errorf("ERASURE_INTERVAL_MINUTES must be positive")
+	}
+	ExportSyncMaxEvents = utils.EnvInt("EXPORT_SYNC_MAX_EVENTS", 1000)
+	ExportRetention = time.Duration(utils.EnvInt("EXPORT_RETENTION_HOURS", 24)) * time.Hour
+	db.QueryTimeout = time.Duration(utils.EnvInt("DB_QUERY_TIMEOUT_MS", 5000)) * time.Millisecond
+
 	dbService := db.DbService()
 	defer dbService.Close()
 
+	go erasureWorker(ErasureInterval)
+
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   ORIGINS,
-		AllowedMethods:   METHODS,
-		AllowCredentials: true,
-	}))
+	r.Use(middleware.RequestID)
+	r.Use(Tracing)
+	r.Use(RequestLogger)
+	r.Use(Metrics)
 
+	// Probes skip CORS and content negotiation
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+	r.Get("/version", getVersion)
 	r.Route("/", apiRoutes)
 
-	port := fmt.Sprintf(":%s", os.Getenv("GO_PORT"))
-	fmt.Printf("Listening on: http://localhost%s\n", port)
-	http.ListenAndServe(port, r)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", os.Getenv("GO_PORT")),
+		Handler: r,
+	}
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", "http://localhost"+srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serveErr:
+		return err
+	case <-stop.Done():
+	}
+
+	// Fail readiness first and keep serving while load balancers notice,
+	// then stop accepting connections and wait for requests in flight
+	shuttingDown.Store(true)
+	drain := time.Duration(utils.EnvInt("SHUTDOWN_DRAIN_SECONDS", 5)) * time.Second
+	slog.Info("shutting down", "drain", drain)
+	time.Sleep(drain)
+
+	timeout := time.Duration(utils.EnvInt("SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("shutdown incomplete", "error", err)
+	}
+	return nil
 }
 
 func apiRoutes(r chi.Router) {
+	produceJSON := Produces(MediaTypes["JSON"])
+	publicCORS, credentialedCORS := CORS.Public(), CORS.Credentialed()
+
 	r.Route("/", func(r chi.Router) {
+		r.Use(publicCORS)
+		r.Use(produceJSON)
 		r.Route("/{country}", func(r chi.Router) {
 			r.Use(CountryCtx)
 			r.Get("/", getCountry)
@@ -47,59 +154,73 @@ func apiRoutes(r chi.Router) {
 		r.Get("/", index)
 	})
 	r.Route("/user", func(r chi.Router) {
+		r.Use(credentialedCORS)
 		r.Group(func(r chi.Router) {
+			r.Use(produceJSON)
 			r.Use(VerifyTypeJSON)
 			r.Post("/", createUser)
 		})
+		r.With(produceJSON, TokenRequired, RequireScope(ScopeUsersRead)).Get("/", listUsers)
 		r.Route("/password", func(r chi.Router) {
-			r.Use(VerifyTypeJSON)
+			r.Use(produceJSON)
+			r.Use(VerifyTypeJSONOrForm)
 			r.Post("/", createPasswordToken)
 			r.Put("/", changePassword)
 		})
 		r.Route("/{user_id}", func(r chi.Router) {
 			r.Use(TokenRequired)
-			r.Get("/", getUserInfo)
-			r.Patch("/", modifyUser)
-
 			r.Group(func(r chi.Router) {
-				r.Use(VerifyTypeJSON)
-				r.Use(validateUserCreds)
-				r.Delete("/", deleteUserAccount)
+				r.Use(produceJSON)
+				r.With(RequireScope(ScopeProfileRead)).Get("/", getUserInfo)
+				r.Group(func(r chi.Router) {
+					r.Use(RequireScope(ScopeProfileWrite))
+					r.With(VerifyTypeMergePatch).Patch("/", modifyUser)
+					r.With(VerifyTypeJSON).Put("/password", updatePassword)
+					r.Post("/deactivate", deactivateAccount)
+					r.With(VerifyTypeJSON, validateUserCreds).Delete("/", deleteUserAccount)
+				})
+			})
+			r.Route("/apikeys", func(r chi.Router) {
+				r.Use(produceJSON)
+				r.With(RequireScope(ScopeKeysRead)).Get("/", listApiKeys)
+				r.With(RequireScope(ScopeKeysWrite), VerifyTypeJSON).Post("/", createApiKey)
+				r.With(RequireScope(ScopeKeysWrite)).Delete("/{key_id}", revokeApiKey)
+			})
+			r.Route("/export", func(r chi.Router) {
+				r.Use(RequireScope(ScopeProfileRead))
+				r.With(Produces(MediaTypes["JSON"], MediaTypes["zip"])).Get("/", exportUserData)
+				r.With(produceJSON).Get("/{job_id}", getExportStatus)
+				r.Get("/{job_id}/download", downloadExport)
 			})
 		})
 	})
 	r.Route("/session", func(r chi.Router) {
-		r.Use(VerifyTypeJSON)
+		r.Use(credentialedCORS)
+		r.Use(produceJSON)
 		r.Group(func(r chi.Router) {
+			r.Use(VerifyTypeJSONOrForm)
+			r.Use(CountLogins)
 			r.Use(validateUserCreds)
 			r.Post("/", loginUser)
 		})
-		r.Group(func(r chi.Router) {
-			r.Use(TokenRequired)
-			r.Post("/refresh", RefreshAccess)
-			r.Delete("/", logoutUser)
-		})
+		// expired access tokens are accepted here, RefreshAccess checks the token itself
+		r.With(VerifyTypeJSONOrFormOrEmpty).Post("/refresh", RefreshAccess)
+		r.With(VerifyTypeJSONOrForm).Post("/token", exchangeToken)
+		// any audience may log out, logoutUser checks the token itself
+		r.With(VerifyTypeJSONOrFormOrEmpty).Delete("/", logoutUser)
 	})
+	r.With(credentialedCORS, produceJSON).Route("/admin", adminRoutes)
 	r.Route("/checkjwt", func(r chi.Router) {
+		r.Use(credentialedCORS)
+		r.Use(Produces(MediaTypes["text"], MediaTypes["JSON"]))
 		r.Use(TokenRequired)
 		r.Get("/", checkJwt)
 	})
-	r.Get("/publickey", getPublicKey)
-}
-
-func VerifyTypeJSON(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		contentHeader := r.Header.Get("Content-Type")
-		if contentHeader == "" {
-			msg := "Content-Type Header is blank"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return
-		}
-		if contentHeader != MediaTypes["JSON"] {
-			msg := "Unsupported Media Type"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return
-		}
-		next.ServeHTTP(w, r)
+	r.Handle("/metrics", metricsHandler())
+	r.Route("/publickey", func(r chi.Router) {
+		r.Use(publicCORS)
+		r.Use(Produces(MediaTypes["pem"], MediaTypes["text"], MediaTypes["JSON"]))
+		r.Get("/", getPublicKey)
 	})
+	r.With(publicCORS, produceJSON).Get("/.well-known/jwks.json", getJWKS)
 }
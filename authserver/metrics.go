@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_http_requests_total",
+		Help: "HTTP requests by method, chi route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authapi_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and chi route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	loginAttempts = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "authapi_login_attempts_total",
+		Help: "Login attempts by result.",
+	}, []string{"result"})
+
+	refreshReuse = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "authapi_refresh_token_reuse_total",
+		Help: "Used refresh tokens presented again. Each one revokes all of the user's sessions.",
+	})
+
+	hashDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "authapi_password_hash_duration_seconds",
+		Help:    "Password key derivation time by algorithm, for hashing and verifying.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"algorithm"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		dbCollector{},
+	)
+	utils.ObserveHash = func(algorithm string, d time.Duration) {
+		hashDuration.WithLabelValues(algorithm).Observe(d.Seconds())
+	}
+}
+
+// Record request count and latency. The route label is the chi pattern,
+// e.g. /user/{user_id}/, so ids don't create new series.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Count login attempts by response status: 2xx success, 5xx error,
+// anything else a failure (bad credentials, expired password, deactivated).
+func CountLogins(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		result := "failure"
+		switch status := ww.Status(); {
+		case status < 300:
+			result = "success"
+		case status >= 500:
+			result = "error"
+		}
+		loginAttempts.WithLabelValues(result).Inc()
+	})
+}
+
+// Prometheus scrape endpoint. METRICS_TOKEN must be sent as a bearer token.
+// Without it scrapes are refused, unless METRICS_PUBLIC opens the endpoint.
+func metricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	token := os.Getenv("METRICS_TOKEN")
+	if token == "" {
+		if utils.EnvBool("METRICS_PUBLIC", false) {
+			slog.Warn("METRICS_PUBLIC is set, /metrics is served without authentication")
+			return handler
+		}
+		slog.Info("METRICS_TOKEN not set, /metrics is disabled")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, http.StatusForbidden, CodeForbidden, "Metrics are disabled, set METRICS_TOKEN")
+		})
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeProblem(w, r, http.StatusUnauthorized, CodeTokenInvalid, "")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+//======================================//
+// ---- Database Metrics Collector ---- //
+//======================================//
+
+var (
+	activeSessionsDesc = prometheus.NewDesc("authapi_active_sessions",
+		"Refresh tokens that are valid and not expired.", nil, nil)
+	poolConnsDesc = prometheus.NewDesc("authapi_db_pool_connections",
+		"Connections in the pgx pool by state.", []string{"state"}, nil)
+	poolMaxConnsDesc = prometheus.NewDesc("authapi_db_pool_max_connections",
+		"Maximum size of the pgx pool.", nil, nil)
+	poolAcquiresDesc = prometheus.NewDesc("authapi_db_pool_acquires_total",
+		"Connections acquired from the pgx pool.", nil, nil)
+	poolAcquireWaitDesc = prometheus.NewDesc("authapi_db_pool_acquire_wait_seconds_total",
+		"Total time spent waiting to acquire a connection.", nil, nil)
+	poolEmptyAcquiresDesc = prometheus.NewDesc("authapi_db_pool_empty_acquires_total",
+		"Acquires that had to wait for a connection because the pool was empty.", nil, nil)
+	poolCanceledAcquiresDesc = prometheus.NewDesc("authapi_db_pool_canceled_acquires_total",
+		"Acquires canceled by their context.", nil, nil)
+	poolNewConnsDesc = prometheus.NewDesc("authapi_db_pool_new_connections_total",
+		"Connections opened by the pool.", nil, nil)
+)
+
+// Reads the sessions table and pool stats on each scrape
+type dbCollector struct{}
+
+func (dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSessionsDesc
+	ch <- poolConnsDesc
+	ch <- poolMaxConnsDesc
+	ch <- poolAcquiresDesc
+	ch <- poolAcquireWaitDesc
+	ch <- poolEmptyAcquiresDesc
+	ch <- poolCanceledAcquiresDesc
+	ch <- poolNewConnsDesc
+}
+
+func (dbCollector) Collect(ch chan<- prometheus.Metric) {
+	dbService := db.DbService()
+
+	count, err := dbService.CountActiveSessions(context.Background())
+	if err != nil {
+		slog.Error("active session count failed", "error", err)
+		ch <- prometheus.NewInvalidMetric(activeSessionsDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(activeSessionsDesc, prometheus.GaugeValue, float64(count))
+	}
+
+	stat := dbService.Stat()
+	gauge, counter := prometheus.GaugeValue, prometheus.CounterValue
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, gauge, float64(stat.AcquiredConns()), "acquired")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, gauge, float64(stat.IdleConns()), "idle")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, gauge, float64(stat.ConstructingConns()), "constructing")
+	ch <- prometheus.MustNewConstMetric(poolMaxConnsDesc, gauge, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, counter, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireWaitDesc, counter, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquiresDesc, counter, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquiresDesc, counter, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolNewConnsDesc, counter, float64(stat.NewConnsCount()))
+}
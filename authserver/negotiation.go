@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"authapi/utils"
+)
+
+// Reject requests whose Content-Type is not one of the given media types.
+// Parameters are ignored apart from charset, which must be utf-8 if given.
+func VerifyContentType(types ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentHeader := r.Header.Get("Content-Type")
+			if contentHeader == "" {
+				writeProblem(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type Header is blank")
+				return
+			}
+			mediaType, ok := utils.ContentMediaType(contentHeader)
+			if !ok {
+				writeProblem(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Unsupported charset")
+				return
+			}
+			for _, t := range types {
+				if mediaType == t {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			writeProblem(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Unsupported Media Type")
+		})
+	}
+}
+
+func VerifyTypeJSON(next http.Handler) http.Handler {
+	return VerifyContentType(MediaTypes["JSON"])(next)
+}
+
+// Login and token endpoints also take form-encoded bodies, as sent by OAuth clients
+func VerifyTypeJSONOrForm(next http.Handler) http.Handler {
+	return VerifyContentType(MediaTypes["JSON"], MediaTypes["form"])(next)
+}
+
+// Cookie session refreshes and logouts send no body, so requests without
+// one are let through
+func VerifyTypeJSONOrFormOrEmpty(next http.Handler) http.Handler {
+	checked := VerifyTypeJSONOrForm(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		checked.ServeHTTP(w, r)
+	})
+}
+
+// Profile updates take JSON Merge Patch documents under either media type
+func VerifyTypeMergePatch(next http.Handler) http.Handler {
+	return VerifyContentType(MediaTypes["JSON"], MediaTypes["merge-patch"])(next)
+}
+
+// Pick the response media type from the Accept header, preferring earlier offers.
+// The choice is read back with responseType.
+// Responds 406 if the client accepts none of the offers.
+func Produces(offers ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType := utils.Negotiate(r.Header.Get("Accept"), offers...)
+			if mediaType == "" {
+				writeProblem(w, r, http.StatusNotAcceptable, CodeNotAcceptable,
+					fmt.Sprintf("Available media types: %v", offers))
+				return
+			}
+			ctx := context.WithValue(r.Context(), mediaTypeKey{}, mediaType)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type mediaTypeKey struct{}
+
+// Media type chosen by Produces, JSON if the route does not negotiate
+func responseType(r *http.Request) string {
+	if mediaType, ok := r.Context().Value(mediaTypeKey{}).(string); ok {
+		return mediaType
+	}
+	return MediaTypes["JSON"]
+}
+
+// Decode a JSON or form-encoded request body into dst. Unknown JSON fields
+// are rejected, unknown form fields ignored since OAuth clients send extras
+// such as client_id. Form fields are matched to dst's JSON field names, so
+// handlers use one struct for both. Only string fields can be set from a form.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+
+	var body io.Reader = r.Body
+	strict := true
+	mediaType, _ := utils.ContentMediaType(r.Header.Get("Content-Type"))
+	if mediaType == MediaTypes["form"] {
+		// read directly, http.Request.ParseForm ignores DELETE bodies
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return err
+		}
+		fields := map[string]string{}
+		for key, vals := range form {
+			if len(vals) != 1 {
+				return fmt.Errorf("field %q given more than once", key)
+			}
+			fields[key] = vals[0]
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		strict = false
+	}
+
+	dec := json.NewDecoder(body)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(dst)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+type PrincipalKind string
+
+const (
+	PrincipalAnonymous   PrincipalKind = "anonymous"
+	PrincipalUser        PrincipalKind = "user"
+	PrincipalApplication PrincipalKind = "application"
+)
+
+// Who a request is made by. TokenRequired sets it from an access token or
+// an API key and validateUserCreds from a username and password. Requests
+// that passed neither are anonymous, so handlers never need to know which ran.
+// API keys are application principals acting for the user that owns them.
+type Principal struct {
+	Kind     PrincipalKind
+	UserId   int
+	Username string
+	IsStaff  bool
+	// Claims of the access token, nil when authenticated by password
+	Claims *utils.TokenClaims
+	// The account as loaded from the database, only when authenticated by password
+	Account *db.UserAuth
+	// The key used by an application principal
+	ApiKey *db.ApiKey
+}
+
+var anonymous = &Principal{Kind: PrincipalAnonymous}
+
+func tokenPrincipal(claims *utils.TokenClaims) *Principal {
+	return &Principal{
+		Kind:     PrincipalUser,
+		UserId:   claims.User_id,
+		Username: claims.Username,
+		IsStaff:  claims.Is_staff,
+		Claims:   claims,
+	}
+}
+
+func accountPrincipal(user *db.UserAuth) *Principal {
+	return &Principal{
+		Kind:     PrincipalUser,
+		UserId:   user.Id,
+		Username: user.Username,
+		IsStaff:  user.IsStaff,
+		Account:  user,
+	}
+}
+
+func apiKeyPrincipal(key *db.ApiKeyAuth) *Principal {
+	return &Principal{
+		Kind:     PrincipalApplication,
+		UserId:   key.UserId,
+		Username: key.Username,
+		IsStaff:  key.IsStaff,
+		ApiKey:   &key.ApiKey,
+	}
+}
+
+func (p *Principal) IsAnonymous() bool {
+	return p.Kind == PrincipalAnonymous
+}
+
+// Reports whether the principal is, or acts for, the user with id userId
+func (p *Principal) Is(userId int) bool {
+	return !p.IsAnonymous() && p.UserId == userId
+}
+
+// Scopes restrict access tokens and API keys. A password proves the user directly.
+func (p *Principal) HasScope(scope string) bool {
+	switch {
+	case p.IsAnonymous():
+		return false
+	case p.ApiKey != nil:
+		return slices.Contains(strings.Fields(p.ApiKey.Scope), scope)
+	}
+	return p.Claims == nil || p.Claims.HasScope(scope)
+}
+
+//===========================//
+// ---- Request Context ---- //
+//===========================//
+
+type principalKey struct{}
+type countryKey struct{}
+type targetKey struct{}
+type tokenRequestKey struct{}
+
+// The request's principal, anonymous if no auth middleware has run
+func PrincipalFrom(ctx context.Context) *Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// Country loaded by CountryCtx, nil outside its routes
+func countryFrom(ctx context.Context) *db.Country {
+	country, _ := ctx.Value(countryKey{}).(*db.Country)
+	return country
+}
+
+// User loaded by AdminTargetCtx, nil outside its routes
+func targetFrom(ctx context.Context) *db.UserAuth {
+	target, _ := ctx.Value(targetKey{}).(*db.UserAuth)
+	return target
+}
+
+// Audience and scope sent with the credentials checked by validateUserCreds
+func tokenRequestFrom(ctx context.Context) db.SessionGrant {
+	grant, _ := ctx.Value(tokenRequestKey{}).(db.SessionGrant)
+	return grant
+}
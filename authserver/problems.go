@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+// Stable machine-readable error codes, sent as "code" in problem responses.
+// Clients should match on these, not on the detail text.
+const (
+	CodeBadRequest             = "bad_request"
+	CodeInvalidBody            = "invalid_body"
+	CodeValidationFailed       = "validation_failed"
+	CodePasswordPolicy         = "password_policy"
+	CodeUnsupportedMediaType   = "unsupported_media_type"
+	CodeNotAcceptable          = "not_acceptable"
+	CodeTokenMissing           = "token_missing"
+	CodeTokenInvalid           = "token_invalid"
+	CodeTokenExpired           = "token_expired"
+	CodeInvalidCredentials     = "invalid_credentials"
+	CodeLoginRequired          = "login_required"
+	CodePasswordChangeRequired = "password_change_required"
+	CodeAccountDeactivated     = "account_deactivated"
+	CodeForbidden              = "forbidden"
+	CodeCSRFFailed             = "csrf_failed"
+	CodeNotFound               = "not_found"
+	CodeUsernameTaken          = "username_taken"
+	CodeEmailTaken             = "email_taken"
+	CodeConflict               = "conflict"
+	CodeApiKeyInvalid          = "api_key_invalid"
+	CodeApiKeyExpired          = "api_key_expired"
+	CodeIPNotAllowed           = "ip_not_allowed"
+	CodeInsufficientScope      = "insufficient_scope"
+	CodeInvalidScope           = "invalid_scope"
+	CodeInvalidTarget          = "invalid_target"
+	CodeTimeout                = "timeout"
+	CodeInternal               = "internal_error"
+)
+
+// Sentinel errors from utils and db and the response each one maps to
+var errorProblems = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{utils.ErrTokenMissing, http.StatusBadRequest, CodeTokenMissing},
+	{utils.ErrTokenInvalid, http.StatusBadRequest, CodeTokenInvalid},
+	{utils.ErrTokenExpired, http.StatusUnauthorized, CodeTokenExpired},
+	{db.ErrNotFound, http.StatusNotFound, CodeNotFound},
+	{db.ErrUsernameTaken, http.StatusConflict, CodeUsernameTaken},
+	{db.ErrEmailTaken, http.StatusConflict, CodeEmailTaken},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, CodeTimeout},
+}
+
+// Write a problem+json response
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	sendProblem(w, r, &utils.Problem{
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	})
+}
+
+// Send a problem for the request. Clients that only accept application/json
+// get the same body with that content type.
+func sendProblem(w http.ResponseWriter, r *http.Request, p *utils.Problem) {
+	p.Instance = r.URL.Path
+	mediaType := utils.Negotiate(r.Header.Get("Accept"), MediaTypes["problem"], MediaTypes["JSON"])
+	if mediaType == "" {
+		mediaType = MediaTypes["problem"]
+	}
+	utils.WriteProblemAs(w, p, mediaType)
+}
+
+// Central error to response mapper.
+// Known sentinel errors get their own status and code. Anything else is
+// logged and answered with a generic 500 so database and key errors
+// never reach the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		// the client went away, nobody is reading the response
+		slog.DebugContext(r.Context(), "request cancelled", "error", err)
+		return
+	}
+	for _, p := range errorProblems {
+		if errors.Is(err, p.err) {
+			writeProblem(w, r, p.status, p.code, "")
+			return
+		}
+	}
+	slog.ErrorContext(r.Context(), "request failed", "error", err)
+	writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+// Scopes for this API's own routes. Tokens without a scope may use all of them.
+const (
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+	ScopeUsersRead    = "users:read"
+	ScopeKeysRead     = "keys:read"
+	ScopeKeysWrite    = "keys:write"
+	ScopeAdmin        = "admin" // only granted to staff
+)
+
+var apiScopes = []string{
+	ScopeProfileRead, ScopeProfileWrite, ScopeUsersRead, ScopeKeysRead, ScopeKeysWrite, ScopeAdmin,
+}
+
+// Audiences and scopes clients may ask for when logging in or exchanging a
+// token. Tokens for another audience are signed by this server but refused
+// by its own routes, the other service checks them against /publickey.
+type TokenGrantConfig struct {
+	// This API's audience. Tokens without an aud are also accepted here.
+	Audience string
+	// Other services tokens may be issued for
+	Audiences []string
+	// Scopes understood by those services, on top of the API's own
+	Scopes []string
+}
+
+func TokenGrantConfigFromEnv() (TokenGrantConfig, error) {
+	c := TokenGrantConfig{
+		Audience:  os.Getenv("API_AUDIENCE"),
+		Audiences: utils.EnvList("TOKEN_AUDIENCES", []string{}),
+		Scopes:    utils.EnvList("TOKEN_SCOPES", []string{}),
+	}
+	if c.Audience == "" {
+		c.Audience = "authapi"
+	}
+	for _, scope := range c.Scopes {
+		if strings.ContainsAny(scope, " \"\\") {
+			return c, fmt.Errorf("TOKEN_SCOPES: invalid scope %q", scope)
+		}
+	}
+	return c, nil
+}
+
+// Check a requested audience and scope. Unknown audiences and scopes are
+// refused rather than dropped, and only staff may be granted admin.
+// Returns the grant with duplicate scopes removed.
+func (c TokenGrantConfig) validate(grant db.SessionGrant, staff bool) (db.SessionGrant, *utils.Problem) {
+	if grant.Audience != "" && grant.Audience != c.Audience && !slices.Contains(c.Audiences, grant.Audience) {
+		return grant, &utils.Problem{
+			Status: http.StatusBadRequest,
+			Code:   CodeInvalidTarget,
+			Detail: fmt.Sprintf("Unknown audience %q", grant.Audience),
+		}
+	}
+	scopes := []string{}
+	for _, scope := range strings.Fields(grant.Scope) {
+		if !slices.Contains(apiScopes, scope) && !slices.Contains(c.Scopes, scope) {
+			return grant, &utils.Problem{
+				Status: http.StatusBadRequest,
+				Code:   CodeInvalidScope,
+				Detail: fmt.Sprintf("Unknown scope %q", scope),
+			}
+		}
+		if scope == ScopeAdmin && !staff {
+			return grant, &utils.Problem{
+				Status: http.StatusForbidden,
+				Code:   CodeInvalidScope,
+				Detail: "The admin scope is only granted to staff",
+			}
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	grant.Scope = strings.Join(scopes, " ")
+	return grant, nil
+}
+
+// Reports whether a token's audience is this API
+func (c TokenGrantConfig) forAPI(claims *utils.TokenClaims) bool {
+	return claims.Aud == "" || claims.Aud == c.Audience
+}
+
+// Refuse tokens without the scope. Placed after TokenRequired.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !PrincipalFrom(r.Context()).HasScope(scope) {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+				writeProblem(w, r, http.StatusForbidden, CodeInsufficientScope,
+					fmt.Sprintf("Token lacks the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//==========================//
+// ---- Token Exchange ---- //
+//==========================//
+
+// RFC 8693 identifiers
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// request JSON or form for a token exchange.
+// audience and resource both name the target, audience wins if both are sent.
+type tokenExchange struct {
+	GrantType          string `json:"grant_type"`
+	SubjectToken       string `json:"subject_token"`
+	SubjectTokenType   string `json:"subject_token_type"`
+	RequestedTokenType string `json:"requested_token_type"`
+	Audience           string `json:"audience"`
+	Resource           string `json:"resource"`
+	Scope              string `json:"scope"`
+}
+
+type exchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// Swap a user's access token for one with another audience and the same
+// or a narrower scope, e.g. for a service calling another on the user's
+// behalf. The new token never outlives the one it was exchanged for and no
+// refresh token is issued. The caller is not authenticated, holding the
+// subject token is the only proof, so an exchange never widens what it allows.
+func exchangeToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenExchange
+	err := decodeBody(w, r, &req)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidBody, err.Error())
+		return
+	}
+	if req.GrantType != grantTypeTokenExchange {
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "grant_type must be "+grantTypeTokenExchange)
+		return
+	}
+	if req.SubjectTokenType != tokenTypeAccessToken && req.SubjectTokenType != tokenTypeJWT {
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "subject_token_type must be an access_token or jwt")
+		return
+	}
+	issuedType := tokenTypeAccessToken
+	switch req.RequestedTokenType {
+	case "", tokenTypeAccessToken:
+	case tokenTypeJWT:
+		issuedType = tokenTypeJWT
+	default:
+		writeProblem(w, r, http.StatusBadRequest, CodeBadRequest, "requested_token_type must be an access_token or jwt")
+		return
+	}
+
+	subject, err := utils.ValidateAccessToken(req.SubjectToken)
+	if err != nil {
+		if errors.Is(err, utils.ErrTokenExpired) {
+			writeError(w, r, err)
+			return
+		}
+		writeProblem(w, r, http.StatusUnauthorized, CodeTokenInvalid, "Invalid subject_token")
+		return
+	}
+	user, err := db.DbService().SelectUserAuthById(r.Context(), subject.User_id)
+	if errors.Is(err, db.ErrNotFound) {
+		writeProblem(w, r, http.StatusUnauthorized, CodeTokenInvalid, "Invalid subject_token")
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !user.IsActive {
+		writeProblem(w, r, http.StatusForbidden, CodeAccountDeactivated, "Account Deactivated")
+		return
+	}
+
+	grant := db.SessionGrant{Audience: req.Audience, Scope: req.Scope}
+	if grant.Audience == "" {
+		grant.Audience = req.Resource
+	}
+	if grant.Audience == "" {
+		grant.Audience = subject.Aud
+	}
+	if grant.Scope == "" {
+		grant.Scope = subject.Scope
+	}
+	// A token held by another service must not come back as one this API
+	// accepts, and only holds the scopes it lists. Unscoped, it holds none.
+	downstream := !TokenGrants.forAPI(subject)
+	if downstream && (grant.Audience == "" || grant.Audience == TokenGrants.Audience) {
+		writeProblem(w, r, http.StatusForbidden, CodeInvalidTarget,
+			"A token for another audience can't be exchanged for one for this API")
+		return
+	}
+	if downstream && subject.Scope == "" {
+		writeProblem(w, r, http.StatusForbidden, CodeInvalidScope, "subject_token has no scope to exchange")
+		return
+	}
+	// an unscoped subject for this API may be narrowed to anything, a scoped one only to a subset
+	if subject.Scope != "" {
+		for _, scope := range strings.Fields(grant.Scope) {
+			if !subject.HasScope(scope) {
+				writeProblem(w, r, http.StatusForbidden, CodeInvalidScope,
+					fmt.Sprintf("subject_token does not have the %s scope", scope))
+				return
+			}
+		}
+	}
+	grant, problem := TokenGrants.validate(grant, user.IsStaff)
+	if problem != nil {
+		sendProblem(w, r, problem)
+		return
+	}
+
+	exp := time.Now().UTC().Add(time.Minute * 15)
+	if subject.Exp.Before(exp) {
+		exp = subject.Exp
+	}
+	token, err := issueAccessToken(r.Context(), user, grant, exp)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	utils.WriteJSON(w, exchangeResponse{
+		AccessToken:     token,
+		IssuedTokenType: issuedType,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(time.Until(exp).Seconds()),
+		Scope:           grant.Scope,
+	}, 200)
+}
+
+// Sign an access token for the user with a grant
+func issueAccessToken(ctx context.Context, user *db.UserAuth, grant db.SessionGrant, exp time.Time) (string, error) {
+	return signAccessToken(ctx, &utils.TokenClaims{
+		User_id:  user.Id,
+		Username: user.Username,
+		Is_staff: user.IsStaff,
+		Exp:      exp,
+		Aud:      grant.Audience,
+		Scope:    grant.Scope,
+	})
+}
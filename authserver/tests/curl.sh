@@ -4,7 +4,7 @@ curl -X POST http://localhost:3000/register --verbose \
     -d '{
         "Username": "johndoe",
         "FirstName": "John",
-        "LastName": "Doe", "Country": "US", "Password":"12345",
+        "LastName": "Doe", "Country": "US", "Password":"correct-Horse-42",
         "Email": "john.doe@example.com"
     }'
 
@@ -13,7 +13,7 @@ curl http://localhost:3000/login --verbose \
     -H "Accept: application/json" \
     -d '{
         "Username": "johndoe",
-        "Password": "12345"
+        "Password": "correct-Horse-42"
     }'
 
 curl http://localhost:3000/checkjwt --verbose \
@@ -1,5 +1,6 @@
 import requests
 import sys
+import time
 
 
 URL = "http://localhost:3000"
@@ -19,7 +20,7 @@ Help:
 Useage:
     -h help - prints this help text
     -r register user
-    -pw tests with change user password
+    -pw tests with change user password, restored at the end
     -pk gets the public key
     none - perform the other tests
 
@@ -28,7 +29,7 @@ Useage:
 
 user1 = {
     "Username": "johndoe",
-    "Password": "12345",
+    "Password": "correct-Horse-42",
     "Firstname" : "John",
     "Lastname" : "Doe",
     "Email": "john.doe@example.com",
@@ -37,14 +38,17 @@ user1 = {
 
 user2 = {
     "Username": "cedardog",
-    "Password": "1534ghtk",
+    "Password": "1534ghtk-bark",
     "Firstname": "Cedar",
     "Lastname": "Dog",
     "Email": "cedardog@barkmail.com",
     "Country": "XX"
 }
 
-PW_UPDATE = "f88hfhhs2"
+PW_UPDATE = "f88hfhhs2-Battery"
+
+# Must match the server's PW_HISTORY to restore the original password
+PW_HISTORY = 5
 
 
 def register():
@@ -56,6 +60,17 @@ def register():
         sys.exit(1)
 
 
+def register_weak_password():
+    weak = dict(user2, Username="weakpw", Email="weakpw@example.com", Password="12345")
+    res = requests.post(f"{URL}/user", json=weak)
+    try:
+        assert res.status_code == 422
+        assert "min_length" in res.json()["failed_rules"]
+    except AssertionError:
+        print(f"Weak password was not rejected: {res.text}")
+        sys.exit(1)
+
+
 def login():
     content = {
         "username": user1["Username"],
@@ -74,6 +89,22 @@ def login():
     store['refresh'] = data["RefreshToken"]
 
 
+def login_form():
+    """OAuth style form-encoded login"""
+    content = {
+        "grant_type": "password",
+        "username": user1["Username"],
+        "password": user1["Password"]
+    }
+    res = requests.post(f"{URL}/session", data=content)
+    try:
+        assert res.status_code == 201
+        assert "AccessToken" in res.json()
+    except AssertionError:
+        print(f"Form login failed: {res.text}")
+        sys.exit(1)
+
+
 def testToken():
     headers = {
         'Authorization': f'Bearer {store["access"]}'
@@ -90,6 +121,8 @@ def testNoToken():
     res = requests.get(f"{URL}/checkjwt")
     try:
         assert res.status_code == 400
+        assert res.headers["Content-Type"] == "application/problem+json"
+        assert res.json()["code"] == "token_missing"
     except AssertionError:
         print(f"No Token in Header test fail. {res.text}")
         sys.exit(1)
@@ -146,6 +179,161 @@ def refreshDoubleUse():
         sys.exit(1)
 
 
+def scoped_token():
+    """Login with a read only scope, check writes are refused, then exchange
+    the token for a narrower one"""
+    content = {
+        "username": user1["Username"],
+        "password": user1["Password"],
+        "scope": "profile:read users:read"
+    }
+    res = requests.post(f"{URL}/session", json=content)
+    try:
+        assert res.status_code == 201
+        assert res.json()["Scope"] == "profile:read users:read"
+    except AssertionError:
+        print(f"Scoped login failed: {res.text}")
+        sys.exit(1)
+    scoped = res.json()["AccessToken"]
+
+    headers = {"Authorization": f"Bearer {scoped}"}
+    res = requests.post(f"{URL}{store['user_url']}/deactivate", headers=headers)
+    try:
+        assert res.status_code == 403
+        assert res.json()["code"] == "insufficient_scope"
+    except AssertionError:
+        print(f"Write with a read only token was not refused: {res.text}")
+        sys.exit(1)
+
+    exchange = {
+        "grant_type": "urn:ietf:params:oauth:grant-type:token-exchange",
+        "subject_token": scoped,
+        "subject_token_type": "urn:ietf:params:oauth:token-type:access_token",
+        "scope": "profile:read"
+    }
+    res = requests.post(f"{URL}/session/token", data=exchange)
+    try:
+        assert res.status_code == 200
+        assert res.json()["scope"] == "profile:read"
+    except AssertionError:
+        print(f"Token exchange failed: {res.text}")
+        sys.exit(1)
+
+    exchange["scope"] = "profile:write"
+    res = requests.post(f"{URL}/session/token", data=exchange)
+    try:
+        assert res.status_code == 403
+        assert res.json()["code"] == "invalid_scope"
+    except AssertionError:
+        print(f"Token exchange widened the scope: {res.text}")
+        sys.exit(1)
+
+
+def exchange_downstream_token():
+    """A token for another service must not be exchanged back into one for
+    this API. Needs "reports" in TOKEN_AUDIENCES, skipped otherwise"""
+    content = {
+        "username": user1["Username"],
+        "password": user1["Password"],
+        "audience": "reports"
+    }
+    res = requests.post(f"{URL}/session", json=content)
+    if res.status_code == 400 and res.json()["code"] == "invalid_target":
+        print("reports is not in TOKEN_AUDIENCES, skipping downstream exchange test")
+        return
+    try:
+        assert res.status_code == 201
+    except AssertionError:
+        print(f"Login for the reports audience failed: {res.text}")
+        sys.exit(1)
+    login = res.json()
+
+    exchange = {
+        "grant_type": "urn:ietf:params:oauth:grant-type:token-exchange",
+        "subject_token": login["AccessToken"],
+        "subject_token_type": "urn:ietf:params:oauth:token-type:access_token",
+        "audience": "authapi"
+    }
+    res = requests.post(f"{URL}/session/token", data=exchange)
+    try:
+        assert res.status_code == 403
+        assert res.json()["code"] == "invalid_target"
+    except AssertionError:
+        print(f"Downstream token was exchanged for one for this API: {res.text}")
+        sys.exit(1)
+
+    del exchange["audience"]
+    exchange["scope"] = "profile:read"
+    res = requests.post(f"{URL}/session/token", data=exchange)
+    try:
+        assert res.status_code == 403
+        assert res.json()["code"] == "invalid_scope"
+    except AssertionError:
+        print(f"Unscoped downstream token was widened: {res.text}")
+        sys.exit(1)
+
+    # a session for another audience can still log out
+    headers = {"Authorization": f"Bearer {login['AccessToken']}"}
+    res = requests.delete(f"{URL}/session", headers=headers, json={"refresh_token": login["RefreshToken"]})
+    try:
+        assert res.status_code == 204
+    except AssertionError:
+        print(f"Logout of a reports session failed: {res.text}")
+        sys.exit(1)
+    res = requests.post(f"{URL}/session/refresh", headers=headers, json={"refresh_token": login["RefreshToken"]})
+    try:
+        assert res.status_code == 401
+    except AssertionError:
+        print(f"Refresh token survived logout: {res.text}")
+        sys.exit(1)
+
+
+def api_key():
+    """Create a read only API key, use it, check writes are refused, then
+    revoke it"""
+    headers = {"Authorization": f"Bearer {store['access']}"}
+    content = {"name": f"test-{int(time.time())}", "scope": "profile:read"}
+    res = requests.post(f"{URL}{store['user_url']}/apikeys", json=content, headers=headers)
+    try:
+        assert res.status_code == 201
+        assert res.json()["key"].startswith("aak_")
+    except AssertionError:
+        print(f"API key creation failed: {res.text}")
+        sys.exit(1)
+    key = res.json()
+
+    key_headers = {"Authorization": f"ApiKey {key['key']}"}
+    res = requests.get(f"{URL}{store['user_url']}", headers=key_headers)
+    try:
+        assert res.status_code == 200
+    except AssertionError:
+        print(f"Read with an API key failed: {res.text}")
+        sys.exit(1)
+
+    res = requests.post(f"{URL}{store['user_url']}/deactivate", headers=key_headers)
+    try:
+        assert res.status_code == 403
+        assert res.json()["code"] == "insufficient_scope"
+    except AssertionError:
+        print(f"Write with a read only API key was not refused: {res.text}")
+        sys.exit(1)
+
+    res = requests.delete(f"{URL}{store['user_url']}/apikeys/{key['id']}", headers=headers)
+    try:
+        assert res.status_code == 204
+    except AssertionError:
+        print(f"API key revoke failed: {res.text}")
+        sys.exit(1)
+
+    res = requests.get(f"{URL}{store['user_url']}", headers=key_headers)
+    try:
+        assert res.status_code == 401
+        assert res.json()["code"] == "api_key_invalid"
+    except AssertionError:
+        print(f"Revoked API key still works: {res.text}")
+        sys.exit(1)
+
+
 def get_user():
     headers = {"Authorization": f"Bearer {store['access']}"}
     res = requests.get(f"{URL}{store['user_url']}", headers=headers)
@@ -169,6 +357,20 @@ def update_profile():
         sys.exit(1)
 
 
+def update_password_wrong_current():
+    content = {
+        "current_password": "not-the-password",
+        "new_password": PW_UPDATE
+    }
+    headers = {"Authorization": f"Bearer {store['access']}"}
+    res = requests.put(f"{URL}{store['user_url']}/password", headers=headers, json=content)
+    try:
+        assert res.status_code == 401
+    except AssertionError:
+        print(f"Password update with wrong current password not rejected: {res.text}")
+        sys.exit(1)
+
+
 def password_reset_init():
     content = {"email": "johndoe@newemail.com"}
     res = requests.post(f"{URL}/user/password", json=content)
@@ -198,6 +400,43 @@ def password_reset(new_pw: str):
     user1["Password"] = content["password"]
 
 
+def password_reuse_rejected(old_pw: str):
+    content = {
+        "token": store["reset"],
+        "username": "johndoe",
+        "password": old_pw
+    }
+    res = requests.put(f"{URL}/user/password", json=content)
+    try:
+        assert res.status_code == 422
+        assert "recently_used" in res.json()["failed_rules"]
+    except AssertionError:
+        print(f"Password reuse was not rejected: {res.text}")
+        sys.exit(1)
+
+
+def restore_password(original_pw: str):
+    """Cycle out of the password history, then set the original password
+    again so the tests can be re-run"""
+    for i in range(PW_HISTORY):
+        password_reset_init()
+        password_reset(f"{PW_UPDATE}-{i}")
+    password_reset_init()
+    password_reset(original_pw)
+
+
+def probes():
+    res = requests.get(f"{URL}/healthz")
+    ready = requests.get(f"{URL}/readyz")
+    try:
+        assert res.status_code == 200
+        assert ready.status_code == 200
+        assert ready.json()["status"] == "ok"
+    except AssertionError:
+        print(f"Health probes failed: {res.text} {ready.text}")
+        sys.exit(1)
+
+
 def get_pub_key():
     res = requests.get(f"{URL}/publickey")
     print(res.text)
@@ -222,6 +461,7 @@ if __name__ == "__main__":
 
     if len(arg) > 1:
         if arg[1] == '-r':
+            register_weak_password()
             register()
         elif arg[1] == "-pw":
             chgpw = True
@@ -235,8 +475,11 @@ if __name__ == "__main__":
             print("invalid option: use -h for help")
             sys.exit(0)
 
+    probes()
+
     # General login test
     # Test with and without token
+    login_form()
     login()
     testToken()
     testNoToken()
@@ -254,15 +497,22 @@ if __name__ == "__main__":
     refreshToken()
 
     get_user()
+    scoped_token()
+    exchange_downstream_token()
+    api_key()
     update_profile()
+    update_password_wrong_current()
 
     if chgpw:
+        original_pw = user1["Password"]
         password_reset_init()
         password_reset(PW_UPDATE)
         print("Password changed\n")
         password_reset_init()
-        password_reset(user1["Password"])
-        print("Password changed back to original\n")
+        password_reuse_rejected(original_pw)
+        print("Previous password rejected\n")
+        restore_password(original_pw)
+        print("Original password restored\n")
 
     print('\nAll Tests Passed!')
 
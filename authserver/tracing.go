@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"authapi/utils"
+)
+
+var tracer = otel.Tracer("authapi")
+
+// Install the global tracer provider. OTEL_TRACES_EXPORTER picks the exporter:
+// otlp sends to a collector using the standard OTEL_EXPORTER_OTLP_* variables,
+// stdout prints spans, none (the default) only propagates trace context.
+// Returns a function that flushes buffered spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// W3C trace-context and baggage from callers are honoured in every mode
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER must be otlp, stdout or none")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override these
+	res, err := resource.Merge(
+		resource.NewSchemaless(semconv.ServiceName("authapi")),
+		resource.Default(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Reports whether spans are exported anywhere
+func tracingEnabled() bool {
+	exporter := os.Getenv("OTEL_TRACES_EXPORTER")
+	return exporter != "" && exporter != "none"
+}
+
+// Server span for each request, continuing the caller's trace if it sent a
+// traceparent header. Named after the chi route pattern once routing is done.
+// The trace id is added to the request's log lines.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("http.request_id", middleware.GetReqID(ctx)),
+			))
+		defer span.End()
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = utils.WithLogAttrs(ctx, slog.String("trace_id", sc.TraceID().String()))
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// utils.VerifyPassword in a span
+func verifyPassword(ctx context.Context, hash, password string) (bool, error) {
+	_, span := tracer.Start(ctx, "utils.VerifyPassword")
+	defer span.End()
+	valid, err := utils.VerifyPassword(hash, password)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "verify failed")
+	}
+	return valid, err
+}
+
+// utils.GenerateAccessToken in a span
+func signAccessToken(ctx context.Context, claims *utils.TokenClaims) (string, error) {
+	ctx, span := tracer.Start(ctx, "utils.GenerateAccessToken")
+	defer span.End()
+	token, err := utils.GenerateAccessToken(ctx, claims)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "signing failed")
+	}
+	return token, err
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// JWS algorithm names. Each key type maps to exactly one of these, and a
+// token is only verified with a key of the algorithm its header names.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+	AlgRS256 = "RS256"
+)
+
+// The JWS algorithm for a public key: Ed25519 is EdDSA, ECDSA P-256 is
+// ES256 and RSA of at least 2048 bits is RS256. Anything else is refused.
+func KeyAlgorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("ECDSA keys must use P-256 for ES256")
+		}
+		return AlgES256, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return "", fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		return AlgRS256, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// Signer for an in-memory private key of any supported algorithm
+func NewSigner(key crypto.PrivateKey) (Signer, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519Signer(k), nil
+	case *ecdsa.PrivateKey:
+		if _, err := KeyAlgorithm(&k.PublicKey); err != nil {
+			return nil, err
+		}
+		return ecdsaSigner{k}, nil
+	case *rsa.PrivateKey:
+		if _, err := KeyAlgorithm(&k.PublicKey); err != nil {
+			return nil, err
+		}
+		return rsaSigner{k}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+func NewVerifier(key crypto.PublicKey) (Verifier, error) {
+	alg, err := KeyAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	switch alg {
+	case AlgEdDSA:
+		return ed25519Verifier(key.(ed25519.PublicKey)), nil
+	case AlgES256:
+		return ecdsaVerifier{key.(*ecdsa.PublicKey)}, nil
+	default:
+		return rsaVerifier{key.(*rsa.PublicKey)}, nil
+	}
+}
+
+//=================//
+// ---- EdDSA ---- //
+//=================//
+
+type ed25519Signer ed25519.PrivateKey
+
+func (k ed25519Signer) Sign(_ context.Context, msg []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), msg), nil
+}
+
+func (k ed25519Signer) Public() crypto.PublicKey {
+	return ed25519.PrivateKey(k).Public()
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (k ed25519Verifier) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(k), msg, sig)
+}
+
+//=================//
+// ---- ES256 ---- //
+//=================//
+
+// JWS ECDSA signatures are r and s as fixed 32 byte big-endian values
+// (RFC 7518 section 3.4), not the ASN.1 form crypto/ecdsa produces.
+const es256SigSize = 64
+
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (k ecdsaSigner) Sign(_ context.Context, msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return es256Signature(r, s), nil
+}
+
+func (k ecdsaSigner) Public() crypto.PublicKey {
+	return &k.key.PublicKey
+}
+
+type ecdsaVerifier struct {
+	key *ecdsa.PublicKey
+}
+
+func (k ecdsaVerifier) Verify(msg, sig []byte) bool {
+	if len(sig) != es256SigSize {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	digest := sha256.Sum256(msg)
+	return ecdsa.Verify(k.key, digest[:], r, s)
+}
+
+func es256Signature(r, s *big.Int) []byte {
+	sig := make([]byte, es256SigSize)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig
+}
+
+// Convert an ASN.1 ECDSA signature, as most KMS and HSM APIs return, to JWS form
+func ES256FromASN1(der []byte) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("malformed ECDSA signature")
+	}
+	return es256Signature(sig.R, sig.S), nil
+}
+
+//=================//
+// ---- RS256 ---- //
+//=================//
+
+type rsaSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (k rsaSigner) Sign(_ context.Context, msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+}
+
+func (k rsaSigner) Public() crypto.PublicKey {
+	return &k.key.PublicKey
+}
+
+type rsaVerifier struct {
+	key *rsa.PublicKey
+}
+
+func (k rsaVerifier) Verify(msg, sig []byte) bool {
+	digest := sha256.Sum256(msg)
+	return rsa.VerifyPKCS1v15(k.key, crypto.SHA256, digest[:], sig) == nil
+}
+
+// Key id for a public key, the start of the SHA-256 of its PKIX encoding.
+// Stable across restarts and reloads of the same key.
+func KeyId(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64Encode(sum[:12]), nil
+}
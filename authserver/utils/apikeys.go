@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// API keys look like aak_<prefix>_<secret>. The fixed start lets secret
+// scanners spot leaked keys, and the prefix finds the stored key without
+// the secret, which is only kept hashed.
+const ApiKeyStart = "aak_"
+
+const (
+	apiKeyPrefixLen = 12
+	apiKeySecretLen = 32
+)
+
+// A new key and its prefix. The key is shown to its owner once.
+func GenerateApiKey() (key string, prefix string, err error) {
+	id := make([]byte, apiKeyPrefixLen/2)
+	if _, err = rand.Read(id); err != nil {
+		return "", "", err
+	}
+	secret, err := GenerateCryptoString()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(id)
+	return ApiKeyStart + prefix + "_" + secret, prefix, nil
+}
+
+// The prefix of a well formed key
+func ParseApiKey(key string) (prefix string, ok bool) {
+	rest, ok := strings.CutPrefix(key, ApiKeyStart)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(prefix) != apiKeyPrefixLen || len(secret) != apiKeySecretLen {
+		return "", false
+	}
+	return prefix, true
+}
+
+// Keys are 128 random bits, so a plain SHA-256 is enough to store them
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func ApiKeyMatches(key string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashApiKey(key)), []byte(hash)) == 1
+}
@@ -1,20 +1,23 @@
 package utils
 
 import (
-	"crypto/ed25519"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"time"
+)
 
-	"golang.org/x/crypto/scrypt"
+// Access token errors. Wrapped errors give more detail but always match one of these.
+var (
+	ErrTokenMissing = errors.New("header missing")
+	ErrTokenInvalid = errors.New("invalid")
+	ErrTokenExpired = errors.New("expired")
 )
 
 var SECRET []byte = []byte(os.Getenv("SECRET_KEY"))
@@ -39,186 +42,121 @@ func GenerateCryptoString() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-func hasher(salt []byte, plainTxtPW string) ([]byte, error) {
-	passwordBytes := []byte(plainTxtPW)
-
-	hash, err := scrypt.Key(passwordBytes, salt, 32768, 8, 1, 32)
-	if err != nil {
-		return nil, err
-	}
-	passwordHash := append(salt, hash...)
-	return passwordHash, nil
-} // base64.StdEncoding.EncodeToString(passwordHash),
-
-func VerifyPassword(storedHashStr, password string) (bool, error) {
-
-	byteHash, err := base64.StdEncoding.DecodeString(storedHashStr)
-	if err != nil {
-		return false, err
-	}
-	salt := byteHash[:16]
-
-	pwHashBytes, err := hasher(salt, password)
-	if err != nil {
-		fmt.Println(err)
-		return false, err
-
-	}
-
-	pwHashed := base64.StdEncoding.EncodeToString(pwHashBytes)
-
-	if len(pwHashed) != len(storedHashStr) {
-		fmt.Println("Hash not same len")
-		return false, nil
-	}
-
-	if pwHashed != storedHashStr {
-		fmt.Println("Hash Mismatch")
-		return false, nil
-	}
-
-	return true, nil
-}
-
-func GetPasswordHash(plainTxtPW string) string {
-	salt, _ := randomCryptoBytes()
-	hash, _ := hasher(salt, plainTxtPW)
-	return base64.StdEncoding.EncodeToString(hash)
-}
-
 //=========================================//
 // ---- JWT Creation and Verification ---- //
 //=========================================//
 
-var jwtHeader map[string]string = map[string]string{
-	"alg": "HS256",
-	"typ": "JWT",
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
 }
 
+// Aud is the service the token is for and Scope a space separated list of
+// what it may do there. A token without a scope is not restricted.
 type TokenClaims struct {
 	User_id  int       `json:"id"`
 	Username string    `json:"username"`
 	Is_staff bool      `json:"is_staff"`
 	Exp      time.Time `json:"exp"`
+	Aud      string    `json:"aud,omitempty"`
+	Scope    string    `json:"scope,omitempty"`
 }
 
-func base64Encode(src []byte) string {
-	return strings.TrimRight(base64.URLEncoding.EncodeToString(src), "=")
+func (c *TokenClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
 }
 
-// Generate new Access JWT Token
-func GenerateAccessToken(claims *TokenClaims) (string, error) {
-	privKey, err := LoadEd25519PrivateKey()
-	if err != nil {
-		return "", err
+func (c *TokenClaims) HasScope(scope string) bool {
+	if c.Scope == "" {
+		return true
+	}
+	for _, s := range c.Scopes() {
+		if s == scope {
+			return true
+		}
 	}
+	return false
+}
 
-	headerJSON, _ := json.Marshal(jwtHeader)
+func base64Encode(src []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(src), "=")
+}
+
+// Generate new Access JWT Token, signed with the active key in Keys.
+// The header names the key's algorithm and id.
+func GenerateAccessToken(ctx context.Context, claims *TokenClaims) (string, error) {
+	key, signer := Keys.Active()
+	headerJSON, _ := json.Marshal(jwtHeader{Alg: key.Algorithm, Typ: "JWT", Kid: key.Id})
 	payloadJSON, _ := json.Marshal(claims)
 	headerEnc := base64Encode(headerJSON)
 	payloadEnc := base64Encode(payloadJSON)
 	head_payload := fmt.Sprintf("%s.%s", headerEnc, payloadEnc)
 
-	sha := sha256.New()
-	sha.Write([]byte(head_payload))
-	signer := ed25519.Sign(privKey, []byte(head_payload))
-	signerEnc := base64Encode(signer)
+	sig, err := signer.Sign(ctx, []byte(head_payload))
+	if err != nil {
+		return "", err
+	}
+	signerEnc := base64Encode(sig)
 	return fmt.Sprintf("%s.%s", head_payload, signerEnc), nil
 }
 
 // Verify JWT
 // Returns Payload if no errors while decoding and signature matches
-// Returns 'Expired' Error if expired
+// Returns ErrTokenExpired along with the payload if expired
+// Returns an ErrTokenInvalid error if the token is malformed or the signature does not match
+//
+// The header's kid picks the key, and its alg must be that key's algorithm.
+// A token can never choose how it is verified, so an RSA public key can't
+// be used as an HMAC secret and "none" is never accepted.
 func ValidateAccessToken(jwt string) (*TokenClaims, error) {
-	var header map[string]string
-	var payload TokenClaims
+	return ParseAccessToken(jwt, Keys.Key)
+}
 
-	pubKey, err := LoadEd25519PublicKey()
-	if err != nil {
-		return nil, err
-	}
+// ValidateAccessToken with keys from lookup, for verifying outside this
+// server against a fetched key set
+func ParseAccessToken(jwt string, lookup func(kid string) (*RingKey, bool)) (*TokenClaims, error) {
+	var header jwtHeader
+	var payload TokenClaims
 
 	token := strings.Split(jwt, ".")
+	if len(token) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrTokenInvalid)
+	}
 	signer := token[2]
 	head_payload := fmt.Sprintf("%s.%s", token[0], token[1])
 
 	signerDec, err := base64.RawURLEncoding.DecodeString(signer)
 	if err != nil {
-		fmt.Println("signature Decoding failed")
-		return nil, err
-	}
-
-	// Verify the signature
-	verifyErr := ed25519.Verify(pubKey, []byte(head_payload), signerDec)
-	if !verifyErr {
-		return nil, fmt.Errorf("signature mismatch")
-	}
-
-	headerDec, _ := base64.RawURLEncoding.DecodeString(token[0])
-	json.Unmarshal(headerDec, &header)
-	if header["alg"] != jwtHeader["alg"] {
-		return nil, fmt.Errorf("invalid algorithm")
-	}
-
-	// Decode the payload
-	payloadDec, _ := base64.RawStdEncoding.DecodeString(token[1])
-	json.Unmarshal(payloadDec, &payload)
-
-	if payload.Exp.Before(time.Now().UTC()) {
-		return &TokenClaims{}, fmt.Errorf("expired")
-	}
-
-	return &payload, nil
-}
-
-//====================================//
-// ---- ED25519 Key File Loaders ---- //
-//====================================//
-
-func LoadEd25519PrivateKey() (ed25519.PrivateKey, error) {
-	privateKeyFile, err := os.ReadFile(os.Getenv("PRIV_KEY"))
-	if err != nil {
-		return nil, err
-	}
-
-	block, _ := pem.Decode(privateKeyFile)
-	if block == nil {
-		return nil, fmt.Errorf("failed to parse private Key")
+		return nil, fmt.Errorf("%w: signature decoding failed", ErrTokenInvalid)
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+	headerDec, err := base64.RawURLEncoding.DecodeString(token[0])
+	if err != nil || json.Unmarshal(headerDec, &header) != nil {
+		return nil, fmt.Errorf("%w: header decoding failed", ErrTokenInvalid)
 	}
-
-	privateKey, ok := key.(ed25519.PrivateKey)
+	key, ok := lookup(header.Kid)
 	if !ok {
-		return nil, fmt.Errorf("not an ed25519 private key")
+		return nil, fmt.Errorf("%w: unknown key", ErrTokenInvalid)
 	}
-
-	return privateKey, nil
-}
-
-func LoadEd25519PublicKey() (ed25519.PublicKey, error) {
-	publicKeyFile, err := os.ReadFile(os.Getenv("PUB_KEY"))
-	if err != nil {
-		return nil, err
+	if header.Alg != key.Algorithm {
+		return nil, fmt.Errorf("%w: invalid algorithm", ErrTokenInvalid)
 	}
 
-	block, _ := pem.Decode(publicKeyFile)
-	if block == nil {
-		return nil, fmt.Errorf("failed to parse public key")
+	// Verify the signature
+	if !key.Verify([]byte(head_payload), signerDec) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrTokenInvalid)
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if publicKey == nil || err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	// Decode the payload
+	payloadDec, err := base64.RawURLEncoding.DecodeString(token[1])
+	if err != nil || json.Unmarshal(payloadDec, &payload) != nil {
+		return nil, fmt.Errorf("%w: payload decoding failed", ErrTokenInvalid)
 	}
 
-	pubKey, ok := publicKey.(ed25519.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("not RSA public key")
+	if payload.Exp.Before(time.Now().UTC()) {
+		return &payload, ErrTokenExpired
 	}
 
-	return pubKey, nil
+	return &payload, nil
 }
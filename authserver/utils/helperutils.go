@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func WriteJSON(w http.ResponseWriter, v any, status int) error {
@@ -14,6 +18,79 @@ func WriteJSON(w http.ResponseWriter, v any, status int) error {
 
 func WriteText(w http.ResponseWriter, v any, status int) {
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, v)
 	w.WriteHeader(status)
+	fmt.Fprint(w, v)
+}
+
+// RFC 7807 problem details, with a stable machine-readable code.
+// FailedRules and Fields are extension members for password and validation errors.
+type Problem struct {
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Status      int               `json:"status"`
+	Code        string            `json:"code"`
+	Detail      string            `json:"detail,omitempty"`
+	Instance    string            `json:"instance,omitempty"`
+	FailedRules []string          `json:"failed_rules,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+// Problem type URIs are built from the code so they never change
+const ProblemTypePrefix = "urn:authapi:problem:"
+
+func WriteProblem(w http.ResponseWriter, p *Problem) error {
+	return WriteProblemAs(w, p, "application/problem+json")
+}
+
+// Write a problem with another JSON media type, for clients that do not accept application/problem+json
+func WriteProblemAs(w http.ResponseWriter, p *Problem, mediaType string) error {
+	if p.Type == "" {
+		p.Type = ProblemTypePrefix + p.Code
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	return json.NewEncoder(w).Encode(p)
+}
+
+//===============================//
+// ---- Environment Helpers ---- //
+//===============================//
+
+func EnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func EnvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func EnvDays(key string, fallback int) time.Duration {
+	return time.Duration(EnvInt(key, fallback)) * time.Hour * 24
+}
+
+// Comma separated list, blank entries dropped. Unset falls back.
+func EnvList(key string, fallback []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// Public key in JSON Web Key form (RFC 7517), as served on /.well-known/jwks.json
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewJWK(key *RingKey) (JWK, error) {
+	jwk := JWK{Kid: key.Id, Alg: key.Algorithm, Use: "sig"}
+	switch pub := key.Public.(type) {
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = base64Encode(pub)
+	case *ecdsa.PublicKey:
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		coords := make([]byte, 64)
+		pub.X.FillBytes(coords[:32])
+		pub.Y.FillBytes(coords[32:])
+		jwk.X = base64Encode(coords[:32])
+		jwk.Y = base64Encode(coords[32:])
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64Encode(pub.N.Bytes())
+		jwk.E = base64Encode(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return jwk, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+	return jwk, nil
+}
+
+// Ring key for a JWK. The kid and alg must be the ones this server would
+// give the key, so a key set can't relabel a key with another algorithm.
+func (j JWK) RingKey() (*RingKey, error) {
+	pub, err := j.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+	}
+	key, err := newRingKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+	}
+	if key.Id != j.Kid || key.Algorithm != j.Alg {
+		return nil, fmt.Errorf("jwk %s: kid or alg does not match the key", j.Kid)
+	}
+	return key, nil
+}
+
+func (j JWK) publicKey() (crypto.PublicKey, error) {
+	field := func(v string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(v)
+	}
+	switch j.Kty {
+	case "OKP":
+		x, err := field(j.X)
+		if err != nil || j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "EC":
+		x, errX := field(j.X)
+		y, errY := field(j.Y)
+		if errX != nil || errY != nil || j.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 key")
+		}
+		// ecdh checks the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("invalid P-256 key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "RSA":
+		n, errN := field(j.N)
+		e, errE := field(j.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
@@ -0,0 +1,464 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+// Signs access tokens. The private key may be held in memory or by a remote service.
+type Signer interface {
+	Sign(ctx context.Context, msg []byte) ([]byte, error)
+	Public() crypto.PublicKey
+}
+
+// Checks access token signatures
+type Verifier interface {
+	Verify(msg, sig []byte) bool
+}
+
+//=====================//
+// ---- Key Store ---- //
+//=====================//
+
+// The signing key used for access tokens. Set at startup.
+var Keys *KeyStore
+
+// How long a replaced signing key still verifies after a reload, as long
+// as the access tokens it signed live
+var RetiredKeyLifetime = time.Minute * 15
+
+// Key ring held in memory so tokens are signed and verified without
+// touching the disk. The source's key signs new tokens; public keys from
+// verifyPaths are only trusted for verification, e.g. the previous key
+// during a rotation. A signing key replaced by a reload stays in the ring
+// for RetiredKeyLifetime. Safe for concurrent use while reloading.
+type KeyStore struct {
+	source      KeySource
+	verifyPaths []string
+	keys        atomic.Pointer[loadedKeys]
+
+	// serializes reloads and guards stamps
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+}
+
+type loadedKeys struct {
+	signer    Signer
+	active    *RingKey
+	ring      map[string]*RingKey
+	publicPEM []byte
+	// replaced signing keys in ring, until they stop verifying
+	retired map[string]time.Time
+}
+
+// A verification key in the ring. The algorithm is fixed by the key type.
+type RingKey struct {
+	Id        string
+	Algorithm string
+	Public    crypto.PublicKey
+	Verifier
+}
+
+func newRingKey(pub crypto.PublicKey) (*RingKey, error) {
+	alg, err := KeyAlgorithm(pub)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := NewVerifier(pub)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyId(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &RingKey{kid, alg, pub, verifier}, nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func NewKeyStore(ctx context.Context, source KeySource, verifyPaths []string) (*KeyStore, error) {
+	k := &KeyStore{source: source, verifyPaths: verifyPaths}
+	return k, k.Reload(ctx)
+}
+
+func (k *KeyStore) files() []string {
+	return append(k.source.Files(), k.verifyPaths...)
+}
+
+// Load the keys from the source again. On failure the current keys are kept.
+func (k *KeyStore) Reload(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// stamp before reading so a write during the load is picked up next time
+	stamps := statFiles(k.files())
+	signer, err := k.source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	active, err := newRingKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	ring := map[string]*RingKey{active.Id: active}
+	for _, path := range k.verifyPaths {
+		pub, err := loadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		key, err := newRingKey(pub)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		ring[key.Id] = key
+	}
+	retired := k.retire(active, ring)
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	k.keys.Store(&loadedKeys{
+		signer:    signer,
+		active:    active,
+		ring:      ring,
+		publicPEM: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		retired:   retired,
+	})
+	k.stamps = stamps
+	return nil
+}
+
+// Keep the outgoing signing key, and keys retired by earlier reloads, in
+// ring until their tokens have expired. Keys already in ring stay for good.
+func (k *KeyStore) retire(active *RingKey, ring map[string]*RingKey) map[string]time.Time {
+	retired := map[string]time.Time{}
+	prev := k.keys.Load()
+	if prev == nil {
+		return retired
+	}
+	now := time.Now()
+	for id, until := range prev.retired {
+		if _, kept := ring[id]; !kept && now.Before(until) {
+			ring[id], retired[id] = prev.ring[id], until
+		}
+	}
+	if _, kept := ring[prev.active.Id]; !kept && prev.active.Id != active.Id {
+		ring[prev.active.Id], retired[prev.active.Id] = prev.active, now.Add(RetiredKeyLifetime)
+	}
+	return retired
+}
+
+func (keys *loadedKeys) usable(id string) bool {
+	until, ok := keys.retired[id]
+	return !ok || time.Now().Before(until)
+}
+
+func (k *KeyStore) Sign(ctx context.Context, msg []byte) ([]byte, error) {
+	return k.keys.Load().signer.Sign(ctx, msg)
+}
+
+func (k *KeyStore) Public() crypto.PublicKey {
+	return k.keys.Load().signer.Public()
+}
+
+// Verify with the signing key
+func (k *KeyStore) Verify(msg, sig []byte) bool {
+	return k.keys.Load().active.Verify(msg, sig)
+}
+
+// The key new tokens are signed with and its signer, from the same load
+func (k *KeyStore) Active() (*RingKey, Signer) {
+	keys := k.keys.Load()
+	return keys.active, keys.signer
+}
+
+// A key from the ring by id
+func (k *KeyStore) Key(kid string) (*RingKey, bool) {
+	keys := k.keys.Load()
+	key, ok := keys.ring[kid]
+	if !ok || !keys.usable(kid) {
+		return nil, false
+	}
+	return key, true
+}
+
+// Every key in the ring as a JWK set, the signing key first
+func (k *KeyStore) JWKS() (JWKSet, error) {
+	keys := k.keys.Load()
+	set := JWKSet{Keys: []JWK{}}
+	jwk, err := NewJWK(keys.active)
+	if err != nil {
+		return set, err
+	}
+	set.Keys = append(set.Keys, jwk)
+	ids := make([]string, 0, len(keys.ring))
+	for id := range keys.ring {
+		if id != keys.active.Id && keys.usable(id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		jwk, err := NewJWK(keys.ring[id])
+		if err != nil {
+			return set, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// Public key in PKIX PEM form, as served on /publickey
+func (k *KeyStore) PublicKeyPEM() []byte {
+	return k.keys.Load().publicPEM
+}
+
+// Reload whenever one of the ring's files changes, checking every interval
+// until ctx is done. Tokens signed with a replaced key stop verifying
+// RetiredKeyLifetime later unless its public key is kept in verifyPaths.
+func (k *KeyStore) Watch(ctx context.Context, interval time.Duration) {
+	if len(k.files()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		k.mu.Lock()
+		changed := !stampsEqual(k.stamps, statFiles(k.files()))
+		k.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := k.Reload(ctx); err != nil {
+			slog.Error("signing key reload failed, keeping the previous key", "error", err)
+			continue
+		}
+		slog.Info("signing key reloaded")
+	}
+}
+
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		// missing files get a zero stamp, so they count as changed once they appear
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{info.ModTime(), info.Size()}
+		} else {
+			stamps[path] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+func stampsEqual(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		if b[path] != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+//=======================//
+// ---- Key Sources ---- //
+//=======================//
+
+// Where the signing key comes from
+type KeySource interface {
+	Load(ctx context.Context) (Signer, error)
+	// Files the key is read from, watched for changes. None for env and remote sources.
+	Files() []string
+}
+
+// Picks the key source named by KEY_SOURCE: file (default), env, encrypted-file or remote
+func KeySourceFromEnv() (KeySource, error) {
+	switch os.Getenv("KEY_SOURCE") {
+	case "", "file":
+		return PEMFileSource{PrivatePath: os.Getenv("PRIV_KEY"), PublicPath: os.Getenv("PUB_KEY")}, nil
+	case "env":
+		if os.Getenv("PRIV_KEY_B64") == "" {
+			return nil, fmt.Errorf("KEY_SOURCE=env requires PRIV_KEY_B64")
+		}
+		return Base64EnvSource{Var: "PRIV_KEY_B64"}, nil
+	case "encrypted-file":
+		src := EncryptedPEMFileSource{
+			Path:           os.Getenv("PRIV_KEY"),
+			Passphrase:     os.Getenv("PRIV_KEY_PASSPHRASE"),
+			PassphraseFile: os.Getenv("PRIV_KEY_PASSPHRASE_FILE"),
+		}
+		if src.Passphrase == "" && src.PassphraseFile == "" {
+			return nil, fmt.Errorf("KEY_SOURCE=encrypted-file requires PRIV_KEY_PASSPHRASE or PRIV_KEY_PASSPHRASE_FILE")
+		}
+		return src, nil
+	case "remote":
+		name := os.Getenv("REMOTE_SIGNER")
+		open, ok := remoteSigners[name]
+		if !ok {
+			return nil, fmt.Errorf("REMOTE_SIGNER %q is not registered, see utils.RegisterRemoteSigner", name)
+		}
+		client, err := open()
+		if err != nil {
+			return nil, fmt.Errorf("remote signer %s: %w", name, err)
+		}
+		return RemoteSource{Client: client, KeyId: os.Getenv("KEY_ID")}, nil
+	default:
+		return nil, fmt.Errorf("KEY_SOURCE must be file, env, encrypted-file or remote")
+	}
+}
+
+// Unencrypted PKCS#8 private key in a PEM file. If PublicPath is set the
+// public key there must match, catching a half-rotated key pair.
+type PEMFileSource struct {
+	PrivatePath string
+	PublicPath  string
+}
+
+func (s PEMFileSource) Load(ctx context.Context) (Signer, error) {
+	data, err := os.ReadFile(s.PrivatePath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if s.PublicPath == "" {
+		return signer, nil
+	}
+
+	pub, err := loadPublicKey(s.PublicPath)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(signer.Public()) {
+		return nil, fmt.Errorf("public key does not match private key")
+	}
+	return signer, nil
+}
+
+func (s PEMFileSource) Files() []string {
+	if s.PublicPath == "" {
+		return []string{s.PrivatePath}
+	}
+	return []string{s.PrivatePath, s.PublicPath}
+}
+
+// Base64 PKCS#8 key in an environment variable, either a whole PEM file or bare DER.
+// For platforms that inject secrets as variables rather than files.
+type Base64EnvSource struct {
+	Var string
+}
+
+func (s Base64EnvSource) Load(ctx context.Context) (Signer, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(os.Getenv(s.Var)))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64: %w", s.Var, err)
+	}
+	if strings.HasPrefix(string(data), "-----BEGIN") {
+		return parsePrivateKey(data)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key)
+}
+
+func (s Base64EnvSource) Files() []string {
+	return nil
+}
+
+// Passphrase protected PKCS#8 key, a PEM "ENCRYPTED PRIVATE KEY" block as
+// written by `openssl pkcs8 -topk8 -v2 aes-256-cbc`. The passphrase comes
+// from PassphraseFile if set, which is reread on every load.
+type EncryptedPEMFileSource struct {
+	Path           string
+	Passphrase     string
+	PassphraseFile string
+}
+
+func (s EncryptedPEMFileSource) Load(ctx context.Context) (Signer, error) {
+	passphrase := s.Passphrase
+	if s.PassphraseFile != "" {
+		data, err := os.ReadFile(s.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not an encrypted PKCS#8 key", s.Path)
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return NewSigner(key)
+}
+
+func (s EncryptedPEMFileSource) Files() []string {
+	if s.PassphraseFile == "" {
+		return []string{s.Path}
+	}
+	return []string{s.Path, s.PassphraseFile}
+}
+
+func parsePrivateKey(data []byte) (Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key)
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse public key %s", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,529 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+func newEd25519(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePrivate(t *testing.T, path string, key crypto.PrivateKey) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, path, "PRIVATE KEY", der)
+}
+
+func writePublic(t *testing.T, path string, key crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, path, "PUBLIC KEY", der)
+}
+
+func kid(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+	id, err := KeyId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// Sign with the store and check the signature against its own key
+func signVerifies(t *testing.T, keys *KeyStore) bool {
+	t.Helper()
+	msg := []byte("header.payload")
+	sig, err := keys.Sign(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys.Verify(msg, sig)
+}
+
+//=======================//
+// ---- Key Sources ---- //
+//=======================//
+
+func TestPEMFileSource(t *testing.T) {
+	dir := t.TempDir()
+	key := newEd25519(t)
+	priv, pub := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	writePrivate(t, priv, key)
+	writePublic(t, pub, key.Public())
+
+	signer, err := PEMFileSource{PrivatePath: priv, PublicPath: pub}.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Public().(ed25519.PublicKey).Equal(signer.Public()) {
+		t.Error("loaded a different key")
+	}
+
+	writePublic(t, pub, newEd25519(t).Public())
+	if _, err := (PEMFileSource{PrivatePath: priv, PublicPath: pub}).Load(context.Background()); err == nil {
+		t.Error("mismatched public key was accepted")
+	}
+}
+
+func TestBase64EnvSource(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	for name, data := range map[string][]byte{"der": der, "pem": pemData} {
+		t.Setenv("TEST_PRIV_KEY_B64", base64.StdEncoding.EncodeToString(data))
+		signer, err := Base64EnvSource{Var: "TEST_PRIV_KEY_B64"}.Load(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !key.PublicKey.Equal(signer.Public()) {
+			t.Errorf("%s: loaded a different key", name)
+		}
+	}
+
+	t.Setenv("TEST_PRIV_KEY_B64", "not base64!")
+	if _, err := (Base64EnvSource{Var: "TEST_PRIV_KEY_B64"}).Load(context.Background()); err == nil {
+		t.Error("invalid base64 was accepted")
+	}
+}
+
+func TestEncryptedPEMFileSource(t *testing.T) {
+	dir := t.TempDir()
+	key := newEd25519(t)
+	der, err := pkcs8.MarshalPrivateKey(key, []byte("correct horse"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "private.pem")
+	writePEM(t, path, "ENCRYPTED PRIVATE KEY", der)
+	passFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, src := range map[string]EncryptedPEMFileSource{
+		"passphrase":      {Path: path, Passphrase: "correct horse"},
+		"passphrase file": {Path: path, PassphraseFile: passFile},
+	} {
+		signer, err := src.Load(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !key.Public().(ed25519.PublicKey).Equal(signer.Public()) {
+			t.Errorf("%s: loaded a different key", name)
+		}
+	}
+
+	if _, err := (EncryptedPEMFileSource{Path: path, Passphrase: "wrong"}).Load(context.Background()); err == nil {
+		t.Error("wrong passphrase was accepted")
+	}
+}
+
+func TestKeySourceFromEnvRemote(t *testing.T) {
+	t.Setenv("KEY_SOURCE", "remote")
+	t.Setenv("REMOTE_SIGNER", "fake")
+	if _, err := KeySourceFromEnv(); err == nil {
+		t.Error("unregistered remote signer was accepted")
+	}
+
+	RegisterRemoteSigner("test", func() (RemoteSigner, error) { return NewFakeRemoteSigner(), nil })
+	defer delete(remoteSigners, "test")
+	t.Setenv("REMOTE_SIGNER", "test")
+	t.Setenv("KEY_ID", "signing")
+	src, err := KeySourceFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote, ok := src.(RemoteSource); !ok || remote.KeyId != "signing" {
+		t.Errorf("got source %#v", src)
+	}
+}
+
+//=====================//
+// ---- Key Store ---- //
+//=====================//
+
+func TestKeyStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	priv := filepath.Join(dir, "private.pem")
+	first := newEd25519(t)
+	writePrivate(t, priv, first)
+	old := filepath.Join(dir, "old_public.pem")
+	previous := newEd25519(t)
+	writePublic(t, old, previous.Public())
+
+	keys, err := NewKeyStore(context.Background(), PEMFileSource{PrivatePath: priv}, []string{old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, _ := keys.Active()
+	if active.Id != kid(t, first.Public()) {
+		t.Fatal("signing with the wrong key")
+	}
+	if _, ok := keys.Key(kid(t, previous.Public())); !ok {
+		t.Error("verify-only key missing from the ring")
+	}
+	if !signVerifies(t, keys) {
+		t.Error("signature did not verify")
+	}
+
+	second := newEd25519(t)
+	writePrivate(t, priv, second)
+	if err := keys.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	active, _ = keys.Active()
+	if active.Id != kid(t, second.Public()) {
+		t.Error("reload did not pick up the new key")
+	}
+	if !signVerifies(t, keys) {
+		t.Error("signature did not verify after reload")
+	}
+	if _, ok := keys.Key(kid(t, first.Public())); !ok {
+		t.Error("replaced key stopped verifying at once")
+	}
+
+	if err := os.WriteFile(priv, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Reload(context.Background()); err == nil {
+		t.Error("reload of a broken key succeeded")
+	}
+	active, _ = keys.Active()
+	if active.Id != kid(t, second.Public()) {
+		t.Error("failed reload replaced the key")
+	}
+}
+
+func TestKeyStoreRetiresReplacedKey(t *testing.T) {
+	defer func(lifetime time.Duration) { RetiredKeyLifetime = lifetime }(RetiredKeyLifetime)
+	dir := t.TempDir()
+	priv := filepath.Join(dir, "private.pem")
+	first := newEd25519(t)
+	writePrivate(t, priv, first)
+	keys, err := NewKeyStore(context.Background(), PEMFileSource{PrivatePath: priv}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RetiredKeyLifetime = 50 * time.Millisecond
+	writePrivate(t, priv, newEd25519(t))
+	if err := keys.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	firstId := kid(t, first.Public())
+	if set, _ := keys.JWKS(); len(set.Keys) != 2 {
+		t.Errorf("got %d keys in the set, want the retired one too", len(set.Keys))
+	}
+	// a reload without a new key keeps the retired key's deadline
+	if err := keys.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.Key(firstId); !ok {
+		t.Fatal("retired key dropped before its lifetime")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := keys.Key(firstId); ok {
+		t.Error("retired key still verifies after its lifetime")
+	}
+	if set, _ := keys.JWKS(); len(set.Keys) != 1 {
+		t.Errorf("got %d keys in the set after the lifetime, want 1", len(set.Keys))
+	}
+}
+
+func TestKeyStoreWatch(t *testing.T) {
+	dir := t.TempDir()
+	priv := filepath.Join(dir, "private.pem")
+	writePrivate(t, priv, newEd25519(t))
+	keys, err := NewKeyStore(context.Background(), PEMFileSource{PrivatePath: priv}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keys.Watch(ctx, 10*time.Millisecond)
+
+	next := newEd25519(t)
+	writePrivate(t, priv, next)
+	// ed25519 PEM files are all the same size, make sure the stamp moves
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(priv, later, later); err != nil {
+		t.Fatal(err)
+	}
+	want := kid(t, next.Public())
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if active, _ := keys.Active(); active.Id == want {
+			return
+		}
+	}
+	t.Error("watch did not reload the changed key")
+}
+
+func TestFakeRemoteSigner(t *testing.T) {
+	fake := NewFakeRemoteSigner()
+	keys, err := NewKeyStore(context.Background(), RemoteSource{Client: fake, KeyId: "signing"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signVerifies(t, keys) {
+		t.Error("remote signature did not verify")
+	}
+	if fake.Signs != 1 {
+		t.Errorf("got %d remote signs, want 1", fake.Signs)
+	}
+	active, _ := keys.Active()
+
+	fake.Err = errors.New("kms unreachable")
+	if _, err := keys.Sign(context.Background(), []byte("msg")); err == nil {
+		t.Error("sign succeeded with the signer failing")
+	}
+	if err := keys.Reload(context.Background()); err == nil {
+		t.Error("reload succeeded with the signer failing")
+	}
+	if current, _ := keys.Active(); current.Id != active.Id {
+		t.Error("failed reload replaced the key")
+	}
+}
+
+//======================//
+// ---- Algorithms ---- //
+//======================//
+
+// A signer for each supported algorithm
+func testSigners(t *testing.T) map[string]Signer {
+	t.Helper()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]Signer{}
+	for alg, key := range map[string]crypto.PrivateKey{AlgEdDSA: newEd25519(t), AlgES256: ec, AlgRS256: rsaKey} {
+		signer, err := NewSigner(key)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		signers[alg] = signer
+	}
+	return signers
+}
+
+// Token with the header as given, signed by signer
+func signedToken(t *testing.T, signer Signer, header jwtHeader) string {
+	t.Helper()
+	headerJSON, _ := json.Marshal(header)
+	payloadJSON, _ := json.Marshal(TokenClaims{User_id: 1, Exp: time.Now().Add(time.Minute)})
+	headPayload := base64Encode(headerJSON) + "." + base64Encode(payloadJSON)
+	sig, err := signer.Sign(context.Background(), []byte(headPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return headPayload + "." + base64Encode(sig)
+}
+
+func TestParseAccessTokenKeySelection(t *testing.T) {
+	signers := testSigners(t)
+	ring := map[string]*RingKey{}
+	for alg, signer := range signers {
+		key, err := newRingKey(signer.Public())
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		ring[alg] = key
+	}
+	lookup := func(kid string) (*RingKey, bool) {
+		for _, key := range ring {
+			if key.Id == kid {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	for alg, signer := range signers {
+		key := ring[alg]
+		token := signedToken(t, signer, jwtHeader{Alg: alg, Typ: "JWT", Kid: key.Id})
+		if _, err := ParseAccessToken(token, lookup); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+
+		for name, header := range map[string]jwtHeader{
+			"empty kid":   {Alg: alg, Typ: "JWT"},
+			"unknown kid": {Alg: alg, Typ: "JWT", Kid: "unknown"},
+			"none":        {Alg: "none", Typ: "JWT", Kid: key.Id},
+			"HS256":       {Alg: "HS256", Typ: "JWT", Kid: key.Id},
+		} {
+			token := signedToken(t, signer, header)
+			if _, err := ParseAccessToken(token, lookup); !errors.Is(err, ErrTokenInvalid) {
+				t.Errorf("%s %s: got %v, want ErrTokenInvalid", alg, name, err)
+			}
+		}
+		for other := range signers {
+			if other == alg {
+				continue
+			}
+			// the header names another algorithm than the kid's key has
+			token := signedToken(t, signer, jwtHeader{Alg: other, Typ: "JWT", Kid: key.Id})
+			if _, err := ParseAccessToken(token, lookup); !errors.Is(err, ErrTokenInvalid) {
+				t.Errorf("%s key labelled %s: got %v, want ErrTokenInvalid", alg, other, err)
+			}
+		}
+	}
+}
+
+func TestES256Signatures(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := NewSigner(key)
+	verifier, err := NewVerifier(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("header.payload")
+	sig, err := signer.Sign(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 {
+		t.Errorf("got a %d byte signature, want 64", len(sig))
+	}
+	if !verifier.Verify(msg, sig) {
+		t.Error("signature did not verify")
+	}
+
+	digest := sha256.Sum256(msg)
+	der, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifier.Verify(msg, der) {
+		t.Error("ASN.1 signature verified as JWS")
+	}
+	converted, err := ES256FromASN1(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted) != 64 || !verifier.Verify(msg, converted) {
+		t.Error("converted signature did not verify")
+	}
+	if _, err := ES256FromASN1(append(der, 0)); err == nil {
+		t.Error("trailing data was accepted")
+	}
+}
+
+func TestKeyAlgorithmRefusesWeakKeys(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigner(small); err == nil {
+		t.Error("1024 bit RSA key was accepted for signing")
+	}
+	if _, err := NewVerifier(&small.PublicKey); err == nil {
+		t.Error("1024 bit RSA key was accepted for verifying")
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := KeyAlgorithm(&p384.PublicKey); err == nil {
+		t.Error("P-384 key was accepted for ES256")
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	msg := []byte("header.payload")
+	for alg, signer := range testSigners(t) {
+		key, err := newRingKey(signer.Public())
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		jwk, err := NewJWK(key)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		// through JSON, as a resource server gets it
+		data, _ := json.Marshal(jwk)
+		var fetched JWK
+		if err := json.Unmarshal(data, &fetched); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := fetched.RingKey()
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if parsed.Id != key.Id || parsed.Algorithm != alg {
+			t.Errorf("%s: got kid %s alg %s", alg, parsed.Id, parsed.Algorithm)
+		}
+		sig, err := signer.Sign(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Verify(msg, sig) {
+			t.Errorf("%s: signature did not verify with the parsed key", alg)
+		}
+
+		relabelled := fetched
+		relabelled.Kid = "another"
+		if _, err := relabelled.RingKey(); err == nil {
+			t.Errorf("%s: relabelled kid was accepted", alg)
+		}
+		relabelled = fetched
+		relabelled.Alg = AlgRS256
+		if alg == AlgRS256 {
+			relabelled.Alg = AlgES256
+		}
+		if _, err := relabelled.RingKey(); err == nil {
+			t.Errorf("%s: relabelled alg was accepted", alg)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Logger for the server. Records carry any attributes added to their context
+// with WithLogAttrs, and pass through Redact before they are written.
+func NewLogger(w io.Writer, level slog.Leveler, jsonFormat bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: Redact}
+	var h slog.Handler
+	if jsonFormat {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// Parse LOG_LEVEL style names: debug, info, warn, error
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+//==================================//
+// ---- Context Log Attributes ---- //
+//==================================//
+
+type logAttrsKey struct{}
+
+// Add attributes, such as the request id or user id, to every record logged with ctx
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(prev)+len(attrs))
+	merged = append(append(merged, prev...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+//=====================//
+// ---- Redaction ---- //
+//=====================//
+
+const redacted = "[REDACTED]"
+
+// Attribute keys whose values are never logged, compared case-insensitively
+var redactedKeys = map[string]bool{
+	"password": true, "passwordhash": true, "password_hash": true, "hash": true,
+	"token": true, "access_token": true, "accesstoken": true,
+	"refresh_token": true, "refreshtoken": true, "reset_token": true,
+	"csrf_token": true, "csrftoken": true, "api_key": true, "apikey": true,
+	"authorization": true, "cookie": true, "set-cookie": true,
+	"secret": true, "secret_key": true, "private_key": true,
+}
+
+// PHC password hashes, JWTs and API keys found inside any logged string
+var secretPattern = regexp.MustCompile(
+	`\$(argon2id|scrypt)\$[A-Za-z0-9$=,+/.]+` +
+		`|eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*` +
+		`|aak_[0-9a-f]{12}_[0-9a-f]{32}`)
+
+// Wraps a value that must never be logged
+type Secret string
+
+func (Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// slog ReplaceAttr hook. Drops the values of sensitive keys, and masks
+// password hashes, JWTs and API keys in strings and errors. Refresh and
+// reset tokens are plain hex like trace ids, and legacy scrypt hashes plain
+// base64, so they are only caught by key: log them as Secret.
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); secretPattern.MatchString(s) {
+			return slog.String(a.Key, RedactString(s))
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactString(err.Error()))
+		}
+	}
+	return a
+}
+
+func RedactString(s string) string {
+	return secretPattern.ReplaceAllString(s, redacted)
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Base media type of a Content-Type header, lowercased and without parameters.
+// A charset other than utf-8 is rejected since request bodies are decoded as UTF-8.
+func ContentMediaType(header string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", false
+	}
+	if cs, ok := params["charset"]; ok && !strings.EqualFold(cs, "utf-8") {
+		return mediaType, false
+	}
+	return mediaType, true
+}
+
+// One media range from an Accept header
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, subtype, _ := strings.Cut(mediaType, "/")
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{typ, subtype, q})
+	}
+	// most specific ranges first, so they take precedence when matching
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+	return ranges
+}
+
+func (m mediaRange) specificity() int {
+	switch {
+	case m.typ == "*":
+		return 0
+	case m.subtype == "*":
+		return 1
+	}
+	return 2
+}
+
+func (m mediaRange) matches(typ, subtype string) bool {
+	return (m.typ == "*" || m.typ == typ) && (m.subtype == "*" || m.subtype == subtype)
+}
+
+// Pick the offered media type the client prefers according to its Accept header.
+// Ties go to the earliest offer, an empty or unparsable header accepts the first offer.
+// Returns "" if the client accepts none of the offers.
+func Negotiate(accept string, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+		for _, m := range ranges {
+			if m.matches(typ, subtype) {
+				if m.q > bestQ {
+					best, bestQ = offer, m.q
+				}
+				break
+			}
+		}
+	}
+	return best
+}
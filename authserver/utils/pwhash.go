@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Supported password hashing algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashScrypt   = "scrypt"
+)
+
+// Cost parameters for password hashing.
+// Hashes are stored as PHC strings so the parameters used for every
+// hash are recorded alongside it and can be raised later.
+type HashParams struct {
+	Algorithm string
+
+	// argon2id
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+
+	// scrypt
+	LogN int
+	R    int
+	P    int
+
+	SaltLen int
+	KeyLen  int
+}
+
+// Parameters used for new hashes. Existing hashes with different
+// parameters are rehashed on the next successful login.
+var PasswordHashing = HashParams{
+	Algorithm: HashArgon2id,
+	Memory:    64 * 1024,
+	Time:      3,
+	Threads:   4,
+	LogN:      15,
+	R:         8,
+	P:         1,
+	SaltLen:   16,
+	KeyLen:    32,
+}
+
+// Build hashing parameters from environment variables, falling back to the defaults
+func HashParamsFromEnv() (HashParams, error) {
+	p := PasswordHashing
+	if alg := os.Getenv("PW_HASH_ALGORITHM"); alg != "" {
+		p.Algorithm = alg
+	}
+	p.Memory = uint32(EnvInt("ARGON2_MEMORY_KIB", int(p.Memory)))
+	p.Time = uint32(EnvInt("ARGON2_TIME", int(p.Time)))
+	p.Threads = uint8(EnvInt("ARGON2_THREADS", int(p.Threads)))
+	p.LogN = EnvInt("SCRYPT_LOG_N", p.LogN)
+	p.R = EnvInt("SCRYPT_R", p.R)
+	p.P = EnvInt("SCRYPT_P", p.P)
+
+	switch p.Algorithm {
+	case HashArgon2id:
+		if p.Memory < 8*uint32(p.Threads) || p.Time < 1 || p.Threads < 1 {
+			return p, fmt.Errorf("invalid argon2id parameters")
+		}
+	case HashScrypt:
+		// the limits scrypt.Key enforces, checked here so hashing can't fail later
+		if p.LogN < 1 || p.LogN > 30 || p.R < 1 || p.P < 1 ||
+			uint64(p.R)*uint64(p.P) >= 1<<30 || p.R > math.MaxInt/128/p.P ||
+			p.R > math.MaxInt/256 || 1<<p.LogN > math.MaxInt/128/p.R {
+			return p, fmt.Errorf("invalid scrypt parameters")
+		}
+	default:
+		return p, fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+	}
+	return p, nil
+}
+
+// Called with the duration of every key derivation when set.
+// Lets the server record hashing cost without utils depending on a metrics library.
+var ObserveHash func(algorithm string, d time.Duration)
+
+// Hash a password with the current parameters, encoded as a PHC string
+func GetPasswordHash(plainTxtPW string) (string, error) {
+	salt := make([]byte, PasswordHashing.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := deriveKey(PasswordHashing, salt, plainTxtPW)
+	if err != nil {
+		return "", err
+	}
+	return encodePHC(PasswordHashing, salt, key), nil
+}
+
+// Check a password against a stored hash using a constant time comparison.
+// Accepts PHC strings as well as the legacy base64(salt||hash) scrypt format.
+func VerifyPassword(storedHashStr, password string) (bool, error) {
+	params, salt, key, err := decodeHash(storedHashStr)
+	if err != nil {
+		return false, err
+	}
+	pwKey, err := deriveKey(params, salt, password)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(pwKey, key) == 1, nil
+}
+
+// Reports whether a stored hash was made with an older algorithm or
+// different parameters than the ones currently configured.
+func NeedsRehash(storedHashStr string) bool {
+	if !strings.HasPrefix(storedHashStr, "$") {
+		return true
+	}
+	params, _, key, err := decodeHash(storedHashStr)
+	if err != nil {
+		return true
+	}
+	cur := PasswordHashing
+	if params.Algorithm != cur.Algorithm || len(key) != cur.KeyLen {
+		return true
+	}
+	switch params.Algorithm {
+	case HashArgon2id:
+		return params.Memory != cur.Memory || params.Time != cur.Time ||
+			params.Threads != cur.Threads
+	case HashScrypt:
+		return params.LogN != cur.LogN || params.R != cur.R || params.P != cur.P
+	}
+	return true
+}
+
+//=============================//
+// ---- PHC Hash Encoding ---- //
+//=============================//
+
+func deriveKey(p HashParams, salt []byte, password string) ([]byte, error) {
+	if ObserveHash != nil {
+		defer func(start time.Time) { ObserveHash(p.Algorithm, time.Since(start)) }(time.Now())
+	}
+	switch p.Algorithm {
+	case HashArgon2id:
+		return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(p.KeyLen)), nil
+	case HashScrypt:
+		return scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+// $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+func encodePHC(p HashParams, salt, key []byte) string {
+	b64 := base64.RawStdEncoding
+	var params string
+	switch p.Algorithm {
+	case HashArgon2id:
+		params = fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, p.Memory, p.Time, p.Threads)
+	case HashScrypt:
+		params = fmt.Sprintf("ln=%d,r=%d,p=%d", p.LogN, p.R, p.P)
+	}
+	return fmt.Sprintf("$%s$%s$%s$%s", p.Algorithm, params, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func decodeHash(stored string) (HashParams, []byte, []byte, error) {
+	var p HashParams
+	if !strings.HasPrefix(stored, "$") {
+		return decodeLegacyHash(stored)
+	}
+
+	fields := strings.Split(stored, "$")
+	if len(fields) < 5 {
+		return p, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	p.Algorithm = fields[1]
+
+	var err error
+	switch p.Algorithm {
+	case HashArgon2id:
+		if len(fields) != 6 {
+			return p, nil, nil, fmt.Errorf("malformed password hash")
+		}
+		var version int
+		if _, err = fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+			return p, nil, nil, err
+		}
+		if version != argon2.Version {
+			return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+		}
+		_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+		if err == nil && (p.Time < 1 || p.Threads < 1) {
+			// argon2 panics on these
+			return p, nil, nil, fmt.Errorf("malformed password hash")
+		}
+	case HashScrypt:
+		if len(fields) != 5 {
+			return p, nil, nil, fmt.Errorf("malformed password hash")
+		}
+		_, err = fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P)
+	default:
+		return p, nil, nil, fmt.Errorf("unsupported hash algorithm %q", p.Algorithm)
+	}
+	if err != nil {
+		return p, nil, nil, err
+	}
+
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := b64.DecodeString(fields[len(fields)-1])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	// an empty key would match any password's empty derivation
+	if len(salt) == 0 || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	p.SaltLen, p.KeyLen = len(salt), len(key)
+	return p, salt, key, nil
+}
+
+// Hashes made before PHC strings were introduced are base64(salt||hash)
+// with a 16 byte salt and scrypt N=32768, r=8, p=1.
+func decodeLegacyHash(stored string) (HashParams, []byte, []byte, error) {
+	p := HashParams{Algorithm: HashScrypt, LogN: 15, R: 8, P: 1, SaltLen: 16, KeyLen: 32}
+	byteHash, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return p, nil, nil, err
+	}
+	if len(byteHash) != p.SaltLen+p.KeyLen {
+		return p, nil, nil, fmt.Errorf("malformed password hash")
+	}
+	return p, byteHash[:p.SaltLen], byteHash[p.SaltLen:], nil
+}
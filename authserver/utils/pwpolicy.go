@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule names reported back to the client when a password is rejected
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleLower     = "lowercase"
+	RuleUpper     = "uppercase"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleUsername  = "contains_username"
+	RuleEmail     = "contains_email"
+	RuleBreached  = "breached"
+	RuleReused    = "recently_used"
+)
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	Breached      *BreachList
+
+	// Number of previous passwords that cannot be reused. 0 disables the check.
+	History int
+
+	// Maximum password age per role. 0 means the password never expires.
+	MaxAgeUser      time.Duration
+	MaxAgeStaff     time.Duration
+	MaxAgeSuperuser time.Duration
+}
+
+// Build the password policy from environment variables.
+// Unset variables fall back to a length-only policy of 8 to 128 characters.
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	p := PasswordPolicy{
+		MinLength:     EnvInt("PW_MIN_LENGTH", 8),
+		MaxLength:     EnvInt("PW_MAX_LENGTH", 128),
+		RequireLower:  EnvBool("PW_REQUIRE_LOWER", false),
+		RequireUpper:  EnvBool("PW_REQUIRE_UPPER", false),
+		RequireDigit:  EnvBool("PW_REQUIRE_DIGIT", false),
+		RequireSymbol: EnvBool("PW_REQUIRE_SYMBOL", false),
+		History:       EnvInt("PW_HISTORY", 5),
+
+		MaxAgeUser:      EnvDays("PW_MAX_AGE_USER_DAYS", 0),
+		MaxAgeStaff:     EnvDays("PW_MAX_AGE_STAFF_DAYS", 0),
+		MaxAgeSuperuser: EnvDays("PW_MAX_AGE_SUPERUSER_DAYS", 0),
+	}
+	if path := os.Getenv("PW_BREACH_FILE"); path != "" {
+		list, err := LoadBreachList(path)
+		if err != nil {
+			return p, err
+		}
+		p.Breached = list
+	}
+	return p, nil
+}
+
+// Check a password against the policy.
+// Returns the names of every rule that failed, empty if the password is acceptable.
+func (p *PasswordPolicy) Check(password, username, email string) []string {
+	var failed []string
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		failed = append(failed, RuleMinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		failed = append(failed, RuleMaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireLower && !lower {
+		failed = append(failed, RuleLower)
+	}
+	if p.RequireUpper && !upper {
+		failed = append(failed, RuleUpper)
+	}
+	if p.RequireDigit && !digit {
+		failed = append(failed, RuleDigit)
+	}
+	if p.RequireSymbol && !symbol {
+		failed = append(failed, RuleSymbol)
+	}
+
+	pwLower := strings.ToLower(password)
+	if username != "" && strings.Contains(pwLower, strings.ToLower(username)) {
+		failed = append(failed, RuleUsername)
+	}
+	if email != "" {
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if strings.Contains(pwLower, strings.ToLower(email)) ||
+			(len(local) >= 3 && strings.Contains(pwLower, local)) {
+			failed = append(failed, RuleEmail)
+		}
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		failed = append(failed, RuleBreached)
+	}
+	return failed
+}
+
+// Reports whether a password last changed at the given time is past the
+// maximum age for the user's role. Superuser takes precedence over staff.
+func (p *PasswordPolicy) Expired(changed time.Time, isStaff, isSuperuser bool) bool {
+	maxAge := p.MaxAgeUser
+	if isSuperuser {
+		maxAge = p.MaxAgeSuperuser
+	} else if isStaff {
+		maxAge = p.MaxAgeStaff
+	}
+	if maxAge <= 0 {
+		return false
+	}
+	return time.Now().UTC().After(changed.Add(maxAge))
+}
+
+//=====================================//
+// ---- Breached Password Lookups ---- //
+//=====================================//
+
+// Offline list of breached password SHA-1 hashes.
+// Lookups mirror the k-anonymity range API: hashes are bucketed by
+// their first 5 hex characters and only the remaining suffix is compared.
+//
+// Two layouts are supported:
+//   - a single file of "HASH:COUNT" lines, loaded into memory
+//   - a directory of range files named by prefix (e.g. "5BAA6" or "5BAA6.txt")
+//     containing "SUFFIX:COUNT" lines, read on demand
+type BreachList struct {
+	dir    string
+	ranges map[string]map[string]struct{}
+}
+
+const breachPrefixLen = 5
+
+func LoadBreachList(path string) (*BreachList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &BreachList{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &BreachList{ranges: map[string]map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" {
+			continue
+		}
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("breach list %s line %d: invalid hash", path, line)
+		}
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:breachPrefixLen], hash[breachPrefixLen:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = map[string]struct{}{}
+		}
+		list.ranges[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Reports whether the password appears in the breach list
+func (b *BreachList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:breachPrefixLen], hash[breachPrefixLen:]
+
+	if b.dir == "" {
+		_, found := b.ranges[prefix][suffix]
+		return found
+	}
+
+	for _, name := range []string{prefix, prefix + ".txt"} {
+		f, err := os.Open(filepath.Join(b.dir, name))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			s, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+			if strings.EqualFold(s, suffix) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"authapi/db"
+	"authapi/utils"
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,50}$`)
+	e164Pattern     = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	countryPattern  = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// Field name -> reason the value was rejected
+type fieldErrors map[string]string
+
+func validateUsername(errs fieldErrors, username string) {
+	if !usernamePattern.MatchString(username) {
+		errs["username"] = "must be 3 to 50 letters, digits, '_', '.' or '-'"
+	}
+}
+
+func validateEmail(errs fieldErrors, email string) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 255 {
+		errs["email"] = "must be a valid email address"
+	}
+}
+
+func validateName(errs fieldErrors, field string, name string) {
+	if utf8.RuneCountInString(name) > 60 {
+		errs[field] = "must be at most 60 characters"
+	}
+}
+
+// Looks up an ISO 3166 alpha-2 code in the countries table.
+// Only database failures are returned as errors.
+func validateCountry(ctx context.Context, errs fieldErrors, code string) (*db.Country, error) {
+	if !countryPattern.MatchString(code) {
+		errs["country"] = "must be an ISO 3166 alpha-2 country code"
+		return nil, nil
+	}
+	country, err := db.DbService().GetCountry(ctx, code)
+	if errors.Is(err, db.ErrNotFound) {
+		errs["country"] = "unknown country code"
+		return nil, nil
+	}
+	return country, err
+}
+
+// Phone numbers are E.164 and must start with the dial code of the user's country
+func validatePhone(errs fieldErrors, phone string, country *db.Country) {
+	if !e164Pattern.MatchString(phone) {
+		errs["phone"] = "must be E.164 format, e.g. +15551231234"
+		return
+	}
+	if country == nil {
+		return
+	}
+	dialcode := country.Phone
+	if dialcode != "" && !strings.HasPrefix(dialcode, "+") {
+		dialcode = "+" + dialcode
+	}
+	if dialcode == "" {
+		errs["phone"] = "requires a country"
+	} else if !strings.HasPrefix(phone, dialcode) {
+		errs["phone"] = fmt.Sprintf("must start with dial code %s for country %s", dialcode, country.Code)
+	}
+}
+
+// Validate a profile update against the user's current profile.
+// A null country is stored as 'XX', no country specified.
+func validateProfileUpdate(ctx context.Context, update *db.ProfileUpdate, current *db.User) (fieldErrors, error) {
+	errs := fieldErrors{}
+
+	if update.Username.Set {
+		if update.Username.Null {
+			errs["username"] = "cannot be null"
+		} else {
+			validateUsername(errs, update.Username.Value)
+		}
+	}
+	if update.Email.Set {
+		if update.Email.Null {
+			errs["email"] = "cannot be null"
+		} else {
+			validateEmail(errs, update.Email.Value)
+		}
+	}
+	if update.FirstName.Set && !update.FirstName.Null {
+		validateName(errs, "first_name", update.FirstName.Value)
+	}
+	if update.LastName.Set && !update.LastName.Null {
+		validateName(errs, "last_name", update.LastName.Value)
+	}
+
+	countryCode := current.Country
+	if update.Country.Set {
+		if update.Country.Null {
+			update.Country = db.PatchField{Set: true, Value: "XX"}
+		}
+		update.Country.Value = strings.ToUpper(update.Country.Value)
+		countryCode = update.Country.Value
+	}
+
+	// the phone number is checked against the country whenever either changes
+	phone := current.Phone
+	if update.Phone.Set {
+		phone = nil
+		if !update.Phone.Null {
+			phone = &update.Phone.Value
+		}
+	}
+	hasPhone := phone != nil && *phone != ""
+	if update.Country.Set || (update.Phone.Set && hasPhone) {
+		country, err := validateCountry(ctx, errs, countryCode)
+		if err != nil {
+			return nil, err
+		}
+		if !update.Country.Set {
+			// existing bad data is not the client's fault
+			delete(errs, "country")
+		}
+		if hasPhone {
+			validatePhone(errs, *phone, country)
+		}
+	}
+	return errs, nil
+}
+
+// Validate a registration with the same rules as a profile update
+func validateNewUser(ctx context.Context, u *db.NewUser) (fieldErrors, error) {
+	errs := fieldErrors{}
+	validateUsername(errs, u.Username)
+	validateEmail(errs, u.Email)
+	validateName(errs, "first_name", u.FirstName)
+	validateName(errs, "last_name", u.LastName)
+
+	if u.Country == "" {
+		u.Country = "XX"
+	}
+	u.Country = strings.ToUpper(u.Country)
+	country, err := validateCountry(ctx, errs, u.Country)
+	if err != nil {
+		return nil, err
+	}
+	if u.Phone != "" {
+		validatePhone(errs, u.Phone, country)
+	}
+	return errs, nil
+}
+
+// Respond 422 with the reason for every rejected field
+func validationError(w http.ResponseWriter, r *http.Request, errs fieldErrors) {
+	sendProblem(w, r, &utils.Problem{
+		Title:  "Validation failed",
+		Status: http.StatusUnprocessableEntity,
+		Code:   CodeValidationFailed,
+		Fields: errs,
+	})
+}
+
+// Decode a JSON Merge Patch profile update.
+// Every unknown or mistyped field is reported, anything other than a JSON object is rejected.
+func decodeProfileUpdate(w http.ResponseWriter, r *http.Request) (*db.ProfileUpdate, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	dec := json.NewDecoder(r.Body)
+
+	var raw map[string]json.RawMessage
+	err := dec.Decode(&raw)
+	if err != nil || raw == nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidBody, "Request body must be a JSON object")
+		return nil, false
+	}
+
+	var update db.ProfileUpdate
+	errs := fieldErrors{}
+	for key, val := range raw {
+		field := update.Field(key)
+		if field == nil {
+			errs[key] = "does not exist or cannot be modified"
+			continue
+		}
+		if json.Unmarshal(val, field) != nil {
+			errs[key] = "must be a string or null"
+		}
+	}
+	if len(errs) > 0 {
+		validationError(w, r, errs)
+		return nil, false
+	}
+	return &update, true
+}
+
+// Validate and apply a profile update to a user.
+// Writes the error response and returns false if the update failed.
+func applyProfileUpdate(w http.ResponseWriter, r *http.Request, id int, update *db.ProfileUpdate) bool {
+	current, err := db.DbService().SelectPrivateUserById(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	errs, err := validateProfileUpdate(r.Context(), update, current)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if len(errs) > 0 {
+		validationError(w, r, errs)
+		return false
+	}
+
+	// taken usernames and emails map to 409 in writeError
+	err = db.DbService().UpdateUserProfile(r.Context(), id, *update)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	return true
+}
@@ -1,5 +1,7 @@
 \c authdb
 
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE SEQUENCE user_id_seq
     START WITH 578
     INCREMENT BY 21;
@@ -21,8 +23,14 @@ CREATE TABLE users (
         -- use countries table to get phone code
     country VARCHAR DEFAULT 'XX', -- Foreign Key
     is_active BOOLEAN DEFAULT TRUE NOT NULL,
+    is_staff BOOLEAN DEFAULT FALSE NOT NULL,
+    is_superuser BOOLEAN DEFAULT FALSE NOT NULL,
     date_joined TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
     last_login TIMESTAMP WITH TIME ZONE,
+    password_changed TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    self_deactivated BOOLEAN DEFAULT FALSE NOT NULL, -- user can reactivate by logging in
+    deletion_scheduled TIMESTAMP WITH TIME ZONE, -- PII is erased after this time
+    anonymized_at TIMESTAMP WITH TIME ZONE,
     session_id VARCHAR(255),
     
     CONSTRAINT phone_requires_country CHECK (
@@ -62,10 +70,74 @@ CREATE TABLE sessions (
     expires TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     valid BOOLEAN DEFAULT TRUE NOT NULL,
     pw_reset BOOLEAN DEFAULT FALSE NOT NULL,
+    -- access tokens from this session are limited to these, '' is unrestricted
+    audience VARCHAR DEFAULT '' NOT NULL,
+    scope VARCHAR DEFAULT '' NOT NULL,
 
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+CREATE TABLE password_history (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    passwordHash VARCHAR(300) NOT NULL,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- user directory search, all keyset paginated on id
+CREATE INDEX users_username_trgm_idx ON users USING gin (username gin_trgm_ops);
+CREATE INDEX users_email_trgm_idx ON users USING gin (email gin_trgm_ops);
+CREATE INDEX users_country_idx ON users (country, id);
+CREATE INDEX users_date_joined_idx ON users (date_joined, id);
+
+CREATE INDEX users_deletion_idx ON users (deletion_scheduled)
+    WHERE deletion_scheduled IS NOT NULL AND anonymized_at IS NULL;
+
+CREATE INDEX password_history_user_idx ON password_history (user_id, created DESC);
+
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    actor_id INT,
+    event VARCHAR(50) NOT NULL,
+    detail JSONB,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX audit_events_user_idx ON audit_events (user_id, created DESC);
+
+-- Long-lived keys for scripts and CI. Only a hash of the key is stored,
+-- prefix is the public part of the key used to look it up.
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    prefix VARCHAR(16) UNIQUE NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    scope VARCHAR NOT NULL,
+    allowed_ips TEXT[] DEFAULT '{}' NOT NULL, -- CIDR prefixes, empty allows any address
+    expires TIMESTAMP WITH TIME ZONE,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used TIMESTAMP WITH TIME ZONE,
+
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Bump with db.SchemaVersion whenever this file changes, and add the
+-- matching file to migrations/ for existing databases.
+-- /readyz fails while the database is behind the server.
+CREATE TABLE schema_version (
+    version INT NOT NULL
+);
+
+INSERT INTO schema_version ( version ) VALUES ( 3 );
+
 
 INSERT INTO countries ( code, country, dialcode ) VALUES
 ('XX', 'No Country Specified', ''),
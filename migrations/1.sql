@@ -0,0 +1,55 @@
+-- Brings a database created before schema_version existed up to version 1:
+-- staff flags, password history and expiry, deactivation and erasure,
+-- audit events and user directory search.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- the server has always read these, some databases added them by hand
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_staff BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_superuser BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE users ADD COLUMN password_changed TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL;
+ALTER TABLE users ADD COLUMN self_deactivated BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE users ADD COLUMN deletion_scheduled TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN anonymized_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE password_history (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    passwordHash VARCHAR(300) NOT NULL,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- current passwords count as history, so they can't be reused either
+INSERT INTO password_history (user_id, passwordHash, created)
+    SELECT id, passwordHash, password_changed FROM users WHERE passwordHash <> '';
+
+CREATE INDEX users_username_trgm_idx ON users USING gin (username gin_trgm_ops);
+CREATE INDEX users_email_trgm_idx ON users USING gin (email gin_trgm_ops);
+CREATE INDEX users_country_idx ON users (country, id);
+CREATE INDEX users_date_joined_idx ON users (date_joined, id);
+
+CREATE INDEX users_deletion_idx ON users (deletion_scheduled)
+    WHERE deletion_scheduled IS NOT NULL AND anonymized_at IS NULL;
+
+CREATE INDEX password_history_user_idx ON password_history (user_id, created DESC);
+
+CREATE TABLE audit_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    actor_id INT,
+    event VARCHAR(50) NOT NULL,
+    detail JSONB,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX audit_events_user_idx ON audit_events (user_id, created DESC);
+
+CREATE TABLE schema_version (
+    version INT NOT NULL
+);
+
+INSERT INTO schema_version ( version ) VALUES ( 1 );
@@ -0,0 +1,5 @@
+-- Audience and scope of the access tokens issued from a session
+ALTER TABLE sessions ADD COLUMN audience VARCHAR DEFAULT '' NOT NULL;
+ALTER TABLE sessions ADD COLUMN scope VARCHAR DEFAULT '' NOT NULL;
+
+UPDATE schema_version SET version = 2;
@@ -0,0 +1,19 @@
+-- Long-lived keys for scripts and CI. Only a hash of the key is stored,
+-- prefix is the public part of the key used to look it up.
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    prefix VARCHAR(16) UNIQUE NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    scope VARCHAR NOT NULL,
+    allowed_ips TEXT[] DEFAULT '{}' NOT NULL, -- CIDR prefixes, empty allows any address
+    expires TIMESTAMP WITH TIME ZONE,
+    created TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used TIMESTAMP WITH TIME ZONE,
+
+    UNIQUE (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+UPDATE schema_version SET version = 3;